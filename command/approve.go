@@ -0,0 +1,103 @@
+package command
+
+import (
+	"flag"
+
+	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/storage"
+)
+
+// pulldeploy approve -app=<app> -version=<version> -env=<env>
+type Approve struct {
+	result     *Result
+	pdcfg      pdconfig.PDConfig
+	appName    string
+	appVersion string
+	envName    string
+}
+
+func (cmd *Approve) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
+
+	var appName, appVersion, envName string
+	cmd.result = NewResult(cmdName)
+	cmd.pdcfg = pdcfg
+
+	cmdFlags := flag.NewFlagSet(cmdName, flag.ExitOnError)
+	cmdFlags.StringVar(&appName, "app", "", "name of the application")
+	cmdFlags.StringVar(&appVersion, "version", "", "version of the application whose release to approve")
+	cmdFlags.StringVar(&envName, "env", "", "environment in which the release was requested")
+	cmdFlags.Parse(osArgs)
+
+	if appName == "" {
+		cmd.result.Errorf("app is a mandatory argument")
+	} else {
+		cmd.appName = appName
+	}
+
+	if appVersion == "" {
+		cmd.result.Errorf("version is a mandatory argument")
+	} else {
+		cmd.appVersion = appVersion
+	}
+
+	if envName == "" {
+		cmd.result.Errorf("env is a mandatory argument")
+	} else {
+		cmd.envName = envName
+	}
+
+	return cmd.result
+}
+
+func (cmd *Approve) Exec() *Result {
+
+	// Ensure the app definition exists.
+	if _, err := cmd.pdcfg.GetAppConfig(cmd.appName); err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Get access to the repo storage.
+	stgcfg := cmd.pdcfg.GetStorageConfig()
+	stg, err := storage.New(storage.AccessMethod(stgcfg.AccessMethod), stgcfg.Params)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
+	// Retrieve the repository index.
+	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
+
+		// Retrieve the environment, and record the approval.
+		if env, err := ri.GetEnv(cmd.envName); err != nil {
+			cmd.result.AppendError(err)
+			return cmd.result
+		} else {
+			if err := env.Approve(cmd.appVersion, getUserName()); err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+			if err := ri.SetEnv(cmd.envName, env); err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+		}
+
+		// Write the index back.
+		if err := setRepoIndex(stg, ri); err != nil {
+			cmd.result.AppendError(err)
+		}
+	} else {
+		cmd.result.AppendError(err)
+	}
+
+	return cmd.result
+}
@@ -2,6 +2,8 @@
 package command
 
 import (
+	"os/user"
+
 	"github.com/mredivo/pulldeploy/pdconfig"
 	"github.com/mredivo/pulldeploy/repo"
 	"github.com/mredivo/pulldeploy/storage"
@@ -39,6 +41,33 @@ func setRepoIndex(stg storage.Storage, ri *repo.Index) error {
 	}
 }
 
+func lockRepoIndex(stg storage.Storage, appName string) (func(), error) {
+	ri := repo.NewIndex(appName)
+	return stg.Lock(ri.IndexPath())
+}
+
+// deleteVersionFiles removes a version's artifact, HMAC and delta from storage,
+// unless its blob is shared with another version or with keepBlob.
+func deleteVersionFiles(stg storage.Storage, ri *repo.Index, versionName, keepBlob string) {
+	if vers, err := ri.GetVersion(versionName); err == nil {
+		if vers.Digest != "" && (vers.BlobName() == keepBlob || ri.BlobReferenced(vers.BlobName(), versionName)) {
+			return
+		}
+		stg.Delete(ri.VersionPath(vers))
+		stg.Delete(ri.VersionHMACPath(vers))
+		if vers.Delta != nil {
+			stg.Delete(ri.DeltaPath(vers))
+		}
+	}
+}
+
+func getUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
 func subtractArray(minuend, subtrahend []string) []string {
 	var difference []string = []string{}
 	for _, s1 := range minuend {
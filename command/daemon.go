@@ -2,48 +2,75 @@ package command
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/signal"
+	"path"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mredivo/pulldeploy/deployment"
 	"github.com/mredivo/pulldeploy/logging"
 	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/repo"
 	"github.com/mredivo/pulldeploy/signaller"
 	"github.com/mredivo/pulldeploy/storage"
 )
 
+// Where the PID file is kept by default, when running as root.
+const kPIDFILE_DIR = "/var/run"
+
 // pulldeploy daemon ...
 type Daemon struct {
 	result     *Result
 	pdcfg      pdconfig.PDConfig
 	envName    string
 	logFile    string
+	pidFile    string
 	lw         *logging.Writer
 	stg        storage.Storage
+	cache      *deployment.Cache
+	peerURL    string
+	fetchAfter map[string]time.Time
+	delayed    chan signaller.Notification
+	rng        *rand.Rand
 	hr         *signaller.Registry
 	myHostname string
 	canary     map[string]int
+	problems   map[string]string
 }
 
 func (cmd *Daemon) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
 
-	var envName, logFile string
+	var envName, logFile, pidFile string
 	cmd.result = NewResult(cmdName)
 	cmd.pdcfg = pdcfg
 
 	cmdFlags := flag.NewFlagSet(cmdName, flag.ExitOnError)
-	cmdFlags.StringVar(&envName, "env", "", "environment to be monitored")
+	cmdFlags.StringVar(&envName, "env", "", "environment to be monitored, unless configured for the application")
 	cmdFlags.StringVar(&logFile, "logfile", "", "name of log file (default stdout)")
+	cmdFlags.StringVar(&pidFile, "pidfile", "", "name of PID file (default "+kPIDFILE_DIR+"/pulldeploy-<env>.pid as root, none otherwise)")
 	cmdFlags.Parse(osArgs)
 
-	if envName == "" {
-		cmd.result.Errorf("env is a mandatory argument")
-	} else {
-		cmd.envName = envName
-	}
+	cmd.envName = envName
 	cmd.logFile = logFile
+	cmd.pidFile = pidFile
+	if pidFile == "" && os.Geteuid() == 0 {
+		if envName != "" {
+			cmd.pidFile = path.Join(kPIDFILE_DIR, "pulldeploy-"+envName+".pid")
+		} else {
+			cmd.pidFile = path.Join(kPIDFILE_DIR, "pulldeploy.pid")
+		}
+	}
 	cmd.canary = make(map[string]int)
+	cmd.problems = make(map[string]string)
+	cmd.fetchAfter = make(map[string]time.Time)
+	cmd.delayed = make(chan signaller.Notification, 16)
+	cmd.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	return cmd.result
 }
@@ -64,6 +91,16 @@ func (cmd *Daemon) Exec() *Result {
 	cmd.lw = logger.GetWriter("", cmd.pdcfg.GetLogLevel())
 	cmd.lw.Info(cmd.pdcfg.GetVersionInfo().OneLine())
 
+	// Only one daemon may run for an environment.
+	if cmd.pidFile != "" {
+		if fp, err := lockPIDFile(cmd.pidFile); err == nil {
+			defer fp.Close()
+		} else {
+			cmd.result.AppendError(err)
+			return cmd.result
+		}
+	}
+
 	// Instantiate the signaller that tells us when apps need attention.
 	sgnlr := signaller.New(cmd.pdcfg.GetSignallerConfig(), cmd.lw)
 	appEvent := sgnlr.Open()
@@ -73,18 +110,44 @@ func (cmd *Daemon) Exec() *Result {
 	// Get access to the repo storage.
 	stgcfg := cmd.pdcfg.GetStorageConfig()
 	if stg, err := storage.New(storage.AccessMethod(stgcfg.AccessMethod), stgcfg.Params); err == nil {
-		cmd.stg = stg
+		cmd.stg = storage.Throttle(stg, int64(cmd.pdcfg.GetSignallerConfig().MaxFetchRate)*1024)
 	} else {
 		cmd.result.AppendError(err)
 		return cmd.result
 	}
 
+	// Open the cache of verified artifacts, if one is configured.
+	if cc := cmd.pdcfg.GetCacheConfig(); cc.Dir != "" {
+		if cache, err := deployment.NewCache(cc.Dir, cc.MaxSize*1024*1024); err == nil {
+			cmd.cache = cache
+			cmd.lw.Info("Artifact cache: %q (%d MB)", cc.Dir, cc.MaxSize)
+		} else {
+			cmd.result.AppendError(err)
+			return cmd.result
+		}
+	}
+
 	// Determine the local hostname.
 	cmd.myHostname, _ = os.Hostname()
 	cmd.lw.Info("Host name: %q", cmd.myHostname)
 
+	// Serve verified artifacts to the other hosts in the environment, if configured.
+	if cmd.pdcfg.GetPeerConfig().Listen != "" {
+		if listener, peerURL, err := startPeerServer(cmd.pdcfg, cmd.lw, cmd.myHostname); err == nil {
+			defer listener.Close()
+			cmd.peerURL = peerURL
+			cmd.lw.Info("Serving artifacts to peers at %s", peerURL)
+		} else {
+			cmd.result.AppendError(err)
+			return cmd.result
+		}
+	}
+
 	// Get the set of applications to monitor.
 	appList := cmd.pdcfg.GetAppList()
+	for _, skipped := range cmd.pdcfg.GetSkippedFiles() {
+		cmd.lw.Info("Skipped %s", skipped)
+	}
 
 	var registerAppHosts = func() {
 		for appName, _ := range appList {
@@ -96,6 +159,14 @@ func (cmd *Daemon) Exec() *Result {
 				continue
 			}
 
+			// Each application is monitored in its own environment.
+			envName := cmd.appEnv(appName)
+			if envName == "" {
+				cmd.lw.Error("Not monitoring %q: no environment configured, and no -env given", appName)
+				continue
+			}
+			cmd.lw.Info("Monitoring %q in %q", appName, envName)
+
 			// Instantiate the deployment object for this application.
 			dplmt, err := deployment.New(appName, cmd.pdcfg, appCfg)
 			if err != nil {
@@ -103,16 +174,33 @@ func (cmd *Daemon) Exec() *Result {
 				continue
 			}
 
+			// Resume or clean up any deployment that was interrupted, unless another
+			// daemon is changing it.
+			if err := dplmt.Lock(); err != nil {
+				cmd.lw.Error("Cannot recover deployments for %q: %s", appName, err.Error())
+			} else if resumed, cleaned, err := dplmt.Recover(); err == nil {
+				for _, version := range resumed {
+					cmd.lw.Info("Completed interrupted deployment of %s version %q", appName, version)
+				}
+				for _, version := range cleaned {
+					cmd.lw.Warn("Removed incomplete deployment of %s version %q", appName, version)
+				}
+			} else {
+				cmd.lw.Error("Error recovering deployments for %q: %s", appName, err.Error())
+			}
+			dplmt.Unlock()
+
 			// Register with current version, and ask for notifications.
-			cmd.hr.Register(cmd.envName, appName, cmd.myHostname,
-				dplmt.GetCurrentLink(), dplmt.GetDeployedVersions())
-			sgnlr.Monitor(cmd.envName, appName)
+			cmd.register(appName, dplmt)
+			sgnlr.Monitor(envName, appName)
 		}
 	}
 
 	var unregisterAppHosts = func() {
 		for appName, _ := range appList {
-			cmd.hr.Unregister(cmd.envName, appName, cmd.myHostname)
+			if envName := cmd.appEnv(appName); envName != "" {
+				cmd.hr.Unregister(envName, appName, cmd.myHostname)
+			}
 		}
 	}
 
@@ -138,6 +226,10 @@ func (cmd *Daemon) Exec() *Result {
 			// Make the local deploy/release state of the app match the repo index.
 			cmd.synchronize(appNotification)
 
+		case appNotification := <-cmd.delayed:
+			// Resume synchronizing an app whose fetch was delayed.
+			cmd.synchronize(appNotification)
+
 		case <-sigusr1:
 			// Close and re-open the logfile.
 			cmd.lw.Info("Received SIGUSR1")
@@ -150,6 +242,9 @@ func (cmd *Daemon) Exec() *Result {
 			unregisterAppHosts()
 			cmd.pdcfg.RefreshAppList()
 			appList = cmd.pdcfg.GetAppList()
+			for _, skipped := range cmd.pdcfg.GetSkippedFiles() {
+				cmd.lw.Info("Skipped %s", skipped)
+			}
 			// Re-register and restart monitoring.
 			registerAppHosts()
 			synchronize()
@@ -169,7 +264,11 @@ func (cmd *Daemon) Exec() *Result {
 
 func (cmd *Daemon) synchronize(an signaller.Notification) {
 
-	cmd.lw.Info("Synchronizing %q in %q (%s)", an.Appname, cmd.envName, an.Source)
+	envName := cmd.appEnv(an.Appname)
+	if envName == "" {
+		return
+	}
+	cmd.lw.Info("Synchronizing %q in %q (%s)", an.Appname, envName, an.Source)
 
 	// Retrieve the app definition.
 	appCfg, err := cmd.pdcfg.GetAppConfig(an.Appname)
@@ -178,11 +277,8 @@ func (cmd *Daemon) synchronize(an signaller.Notification) {
 		return
 	}
 
-	// Get the extension for the artifact type.
-	var extension string
-	if ac, err := cmd.pdcfg.GetArtifactConfig(appCfg.ArtifactType); err == nil {
-		extension = ac.Extension
-	} else {
+	// Validate the artifact type.
+	if _, err := cmd.pdcfg.GetArtifactConfig(appCfg.ArtifactType); err != nil {
 		cmd.lw.Error("Invalid ArtifactType for %q: %q", an.Appname, appCfg.ArtifactType)
 		return
 	}
@@ -193,13 +289,22 @@ func (cmd *Daemon) synchronize(an signaller.Notification) {
 		cmd.lw.Error("Error in deployment for %q: %s", an.Appname, err.Error())
 		return
 	}
+	dplmt.SetCache(cmd.cache)
+	dplmt.SetEnv(envName)
+
+	// Hold the lock on the deployment while changing it.
+	if err := dplmt.Lock(); err != nil {
+		cmd.lw.Error("Cannot synchronize %q: %s", an.Appname, err.Error())
+		return
+	}
+	defer dplmt.Unlock()
 
 	// Retrieve the repository index.
 	if ri, err := getRepoIndex(cmd.stg, an.Appname); err == nil {
 
 		// Retrieve the environment.
-		if env, err := ri.GetEnv(cmd.envName); err != nil {
-			cmd.lw.Error("Error getting %q environment for %q: %s", cmd.envName, an.Appname, err.Error())
+		if env, err := ri.GetEnv(envName); err != nil {
+			cmd.lw.Error("Error getting %q environment for %q: %s", envName, an.Appname, err.Error())
 			return
 		} else {
 
@@ -211,6 +316,13 @@ func (cmd *Daemon) synchronize(an signaller.Notification) {
 				//return
 			}
 
+			// A failed step is reported to the registry, and the on-failure script is run.
+			var problem string
+			var failed = func(step, version string, err error) {
+				problem = fmt.Sprintf("%s of version %q failed: %s", step, version, err.Error())
+				cmd.runHook(dplmt, ri, an.Appname, pdconfig.KHOOK_ONFAILURE, version, dplmt.GetCurrentLink())
+			}
+
 			// Determine whether any new versions have been deployed since we last checked.
 			localVersionList := dplmt.GetDeployedVersions()
 			var deployedVersionList []string
@@ -221,74 +333,172 @@ func (cmd *Daemon) synchronize(an signaller.Notification) {
 			}
 			newDeployments := subtractArray(deployedVersionList, localVersionList)
 			cmd.lw.Debug("Deployments for %s in %s: local=%v, repo=%v new=%v",
-				an.Appname, cmd.envName, localVersionList, deployedVersionList, newDeployments)
+				an.Appname, envName, localVersionList, deployedVersionList, newDeployments)
+
+			// Spread the fetching of new artifacts across the environment with a
+			// random delay; versions that need no fetch go ahead at once.
+			fetchPending := cmd.fetchPending(an.Appname, appCfg, dplmt, newDeployments)
 
 			// Fetch and unpack all new deployments.
 			for _, version := range newDeployments {
+				if fetchPending && !dplmt.ArtifactPresent(version) {
+					continue
+				}
 
-				// Determine the base filename.
-				filename := ri.ArtifactFilename(version, extension)
+				// Determine where the artifact and its HMAC are stored.
+				vers, err := ri.GetVersion(version)
+				if err != nil {
+					continue
+				}
+				artifactPath := ri.VersionPath(vers)
+				hmacPath := ri.VersionHMACPath(vers)
+
+				// Make sure there is room to fetch and extract the artifact, removing old
+				// versions first if so configured.
+				err = cmd.checkSpace(dplmt, appCfg, vers, artifactPath)
+				if err != nil && cmd.pdcfg.GetDiskConfig().Prune {
+					cmd.lw.Info("Removing old versions of %s in %s to make room for version %q",
+						an.Appname, envName, version)
+					cmd.removeVersions(dplmt, ri, env, an.Appname, failed)
+					err = cmd.checkSpace(dplmt, appCfg, vers, artifactPath)
+				}
+				if err != nil {
+					cmd.lw.Error("Skipping deployment of %s in %s, version %q: %s",
+						an.Appname, envName, version, err.Error())
+					failed("Deployment", version, err)
+					continue
+				}
 
-				// Retrieve the artifact for that filename.
+				// Retrieve the artifact for that version, which must match its
+				// HMAC before it is accepted. A verified copy is taken from the
+				// cache, rebuilt from the base of a delta, or fetched from a peer
+				// when one is available. An encrypted artifact is decrypted once
+				// it has been verified, and the plaintext is then signed locally.
 				if !dplmt.ArtifactPresent(version) {
-					if art, err := cmd.stg.GetReader(ri.ArtifactPath(filename)); err == nil {
-						if err := dplmt.WriteArtifact(version, art); err == nil {
+					hmac, err := cmd.stg.Get(hmacPath)
+					if err != nil {
+						cmd.lw.Error("Error getting HMAC %q for %s in %s: %s",
+							hmacPath, envName, an.Appname, err.Error())
+						continue
+					}
+					if !vers.Encrypted && dplmt.WriteCachedArtifact(version, hmac, vers.Digest) == nil {
+						cmd.lw.Debug("Copied artifact %q for %s in %s from cache",
+							artifactPath, envName, an.Appname)
+					} else if !vers.Encrypted && vers.Delta != nil && dplmt.ArtifactPresent(vers.Delta.Base) &&
+						cmd.fetchDelta(dplmt, ri, vers, hmac) == nil {
+						cmd.lw.Debug("Rebuilt artifact %q for %s in %s from version %q",
+							artifactPath, envName, an.Appname, vers.Delta.Base)
+					} else if !vers.Encrypted && cmd.peerURL != "" &&
+						cmd.fetchFromPeers(dplmt, an.Appname, version, hmac, vers.Digest) == nil {
+						cmd.lw.Debug("Copied artifact %q for %s in %s from a peer",
+							artifactPath, envName, an.Appname)
+					} else if art, err := cmd.stg.GetReader(artifactPath); err == nil {
+						if vers.Encrypted {
+							err = dplmt.WriteEncryptedArtifact(version, art, hmac, ri.DataKey)
+						} else {
+							err = dplmt.WriteVerifiedArtifact(version, art, hmac, vers.Digest)
+						}
+						if err == nil {
 							cmd.lw.Debug("Fetched artifact %q for %s in %s",
-								ri.ArtifactPath(filename), cmd.envName, an.Appname)
+								artifactPath, envName, an.Appname)
 						} else {
 							cmd.lw.Error("Error writing artifact %q for %s in %s: %s",
-								ri.ArtifactPath(filename), cmd.envName, an.Appname, err.Error())
+								artifactPath, envName, an.Appname, err.Error())
 							continue
 						}
 					} else {
 						cmd.lw.Error("Error getting artifact %q for %s in %s: %s",
-							ri.ArtifactPath(filename), cmd.envName, an.Appname, err.Error())
+							artifactPath, envName, an.Appname, err.Error())
 						continue
 					}
 				}
 
-				// Retrieve the HMAC for that filename.
+				// Retrieve the HMAC for that version.
 				if !dplmt.HMACPresent(version) {
-					if hmac, err := cmd.stg.Get(ri.HMACPath(filename)); err == nil {
+					if hmac, err := cmd.stg.Get(hmacPath); err == nil {
 						if err := dplmt.WriteHMAC(version, hmac); err == nil {
 							cmd.lw.Debug("Fetched HMAC %q for %s in %s",
-								ri.HMACPath(filename), cmd.envName, an.Appname)
+								hmacPath, envName, an.Appname)
 						} else {
 							cmd.lw.Error("Error writing HMAC %q for %s in %s: %s",
-								ri.HMACPath(filename), cmd.envName, an.Appname, err.Error())
+								hmacPath, envName, an.Appname, err.Error())
 							continue
 						}
 					} else {
 						cmd.lw.Error("Error getting HMAC %q for %s in %s: %s",
-							ri.HMACPath(filename), cmd.envName, an.Appname, err.Error())
+							hmacPath, envName, an.Appname, err.Error())
 						continue
 					}
 				}
 
+				cmd.setStage(dplmt, an.Appname, version, deployment.KSTAGE_FETCHED)
+
 				// Compare the calculated HMAC with the retrieved HMAC.
 				if err := dplmt.CheckHMAC(version); err == nil {
 					cmd.lw.Debug("HMAC comparison succeeded for %s in %s, version %q",
-						an.Appname, cmd.envName, version)
+						an.Appname, envName, version)
+					cmd.setStage(dplmt, an.Appname, version, deployment.KSTAGE_VERIFIED)
 				} else {
 					cmd.lw.Error("HMAC comparison FAILED for %s in %s, version %q",
-						an.Appname, cmd.envName, version)
+						an.Appname, envName, version)
+					failed("Deployment", version, err)
+					continue
+				}
+
+				// Give the pre-deploy command the chance to abandon the deployment.
+				if err := cmd.runHook(dplmt, ri, an.Appname, pdconfig.KHOOK_PREDEPLOY, version, dplmt.GetCurrentLink()); err != nil {
+					failed("Deployment", version, err)
+					continue
+				}
+
+				// Load the values for rendering templates in this environment.
+				vars, err := cmd.pdcfg.GetAppEnvVars(an.Appname, envName)
+				if err != nil {
+					cmd.lw.Error("Error getting template values for %s in %s: %s",
+						an.Appname, envName, err.Error())
+					failed("Deployment", version, err)
 					continue
 				}
 
 				// Extract the artifact to the release directory.
 				if err := dplmt.Extract(version); err == nil {
 					cmd.lw.Debug("Extracted version %q for %s in %s",
-						version, cmd.envName, an.Appname)
+						version, envName, an.Appname)
 				} else {
 					cmd.lw.Error("Extract FAILED for %s in %s, version %q: %s",
-						an.Appname, cmd.envName, version, err.Error())
+						an.Appname, envName, version, err.Error())
+					failed("Deployment", version, err)
 					continue
 				}
 
-				// Execute the post-deploy command.
-				cmd.logPostCommand(dplmt.PostDeploy(version))
-				cmd.hr.Register(cmd.envName, an.Appname, cmd.myHostname,
-					dplmt.GetCurrentLink(), dplmt.GetDeployedVersions())
+				// Link the directories shared by all releases.
+				if err := dplmt.LinkShared(version); err != nil {
+					cmd.lw.Error("Linking shared directories FAILED for %s in %s, version %q: %s",
+						an.Appname, envName, version, err.Error())
+					failed("Deployment", version, err)
+					continue
+				}
+
+				// Render the configuration templates for this environment.
+				if err := dplmt.RenderTemplates(version, vars, versionMetadata(ri, version)); err != nil {
+					cmd.lw.Error("Rendering templates FAILED for %s in %s, version %q: %s",
+						an.Appname, envName, version, err.Error())
+					failed("Deployment", version, err)
+					continue
+				}
+
+				cmd.setStage(dplmt, an.Appname, version, deployment.KSTAGE_EXTRACTED)
+
+				// Execute the post-deploy command, after which the version is ready.
+				cmd.runHook(dplmt, ri, an.Appname, pdconfig.KHOOK_POSTDEPLOY, version, dplmt.GetCurrentLink())
+				cmd.setStage(dplmt, an.Appname, version, deployment.KSTAGE_HOOKS_RAN)
+				if err := dplmt.SetStage(version, deployment.KSTAGE_READY); err != nil {
+					cmd.lw.Error("Error recording deployment of %s in %s, version %q: %s",
+						an.Appname, envName, version, err.Error())
+					failed("Deployment", version, err)
+					continue
+				}
+				cmd.register(an.Appname, dplmt)
 			}
 
 			// Determine the currently released version on the local host, and
@@ -297,19 +507,43 @@ func (cmd *Daemon) synchronize(an signaller.Notification) {
 			currentRelease := env.GetCurrentVersion(cmd.myHostname)
 			cmd.lw.Debug("Current release: local=%q, repo=%q", localRelease, currentRelease)
 			if localRelease != currentRelease && currentRelease != "" {
-				if err := dplmt.Link(currentRelease); err == nil {
+				notDeployed := len(subtractArray([]string{currentRelease}, dplmt.GetDeployedVersions())) > 0
+				if fetchPending && notDeployed {
+					cmd.lw.Debug("Release of %q for %s in %s awaits its fetch",
+						currentRelease, an.Appname, envName)
+				} else if notDeployed {
+					cmd.lw.Error("Error setting current release for %s in %s to %q: version is not deployed",
+						an.Appname, envName, currentRelease)
+				} else if err := cmd.runHook(dplmt, ri, an.Appname, pdconfig.KHOOK_PRERELEASE, currentRelease, localRelease); err != nil {
+					// The pre-release command has vetoed the release.
+					failed("Release", currentRelease, err)
+				} else if err := dplmt.Link(currentRelease); err == nil {
 					cmd.lw.Info("Current release for %s in %s set to %q",
-						an.Appname, cmd.envName, currentRelease)
-					// Execute the post-release command.
-					cmd.logPostCommand(dplmt.PostRelease(currentRelease))
-					cmd.hr.Register(cmd.envName, an.Appname, cmd.myHostname,
-						dplmt.GetCurrentLink(), dplmt.GetDeployedVersions())
+						an.Appname, envName, currentRelease)
+					// Execute the post-release command, or the post-rollback command if
+					// returning to an older version.
+					if isRollback(ri, localRelease, currentRelease) {
+						cmd.runHook(dplmt, ri, an.Appname, pdconfig.KHOOK_POSTROLLBACK, currentRelease, localRelease)
+					} else {
+						cmd.runHook(dplmt, ri, an.Appname, pdconfig.KHOOK_POSTRELEASE, currentRelease, localRelease)
+					}
+					cmd.register(an.Appname, dplmt)
 				} else {
 					cmd.lw.Error("Error setting current release for %s in %s to %q: %s",
-						an.Appname, cmd.envName, currentRelease, err.Error())
+						an.Appname, envName, currentRelease, err.Error())
+					failed("Release", currentRelease, err)
 				}
 			}
 
+			// Remove the versions that are no longer deployed to the environment.
+			cmd.removeVersions(dplmt, ri, env, an.Appname, failed)
+
+			// Report any change in the problems of the local host.
+			if problem != cmd.problems[an.Appname] {
+				cmd.problems[an.Appname] = problem
+				cmd.register(an.Appname, dplmt)
+			}
+
 			// Note that the local host is in sync with the index.
 			cmd.canary[an.Appname] = ri.Canary
 		}
@@ -319,11 +553,230 @@ func (cmd *Daemon) synchronize(an signaller.Notification) {
 	}
 }
 
-func (cmd *Daemon) logPostCommand(cmdline string, err error) {
+// removeVersions removes the versions that are no longer deployed to the environment,
+// other than the current and previous releases, unless the pre-remove command objects.
+func (cmd *Daemon) removeVersions(dplmt *deployment.Deployment, ri *repo.Index, env *repo.Env,
+	appName string, failed func(step, version string, err error)) {
+
+	var envVersionList []string
+	for _, v := range env.Deployed {
+		envVersionList = append(envVersionList, v.Version)
+	}
+	for _, version := range subtractArray(dplmt.GetDeployedVersions(), envVersionList) {
+		if version == dplmt.GetCurrentLink() || version == dplmt.GetPreviousLink() {
+			continue
+		}
+		if err := cmd.runHook(dplmt, ri, appName, pdconfig.KHOOK_PREREMOVE, version, dplmt.GetCurrentLink()); err != nil {
+			failed("Removal", version, err)
+		} else if err := dplmt.Remove(version); err == nil {
+			cmd.lw.Info("Removed version %q for %s in %s", version, appName, cmd.appEnv(appName))
+			cmd.register(appName, dplmt)
+		} else {
+			cmd.lw.Error("Error removing version %q for %s in %s: %s",
+				version, appName, cmd.appEnv(appName), err.Error())
+		}
+	}
+}
+
+// checkSpace returns an error if there is not enough free space to fetch and
+// extract a version, as estimated from the size of its artifact. Versions of
+// unknown size are not checked.
+func (cmd *Daemon) checkSpace(dplmt *deployment.Deployment, appCfg *pdconfig.AppConfig,
+	vers *repo.Version, artifactPath string) error {
+
+	// Older versions do not record their size in the index.
+	size := vers.Size
+	if size == 0 {
+		if fi, err := cmd.stg.Stat(artifactPath); err == nil {
+			size = fi.Size
+		} else {
+			cmd.lw.Debug("Not checking disk space for %q: %s", artifactPath, err.Error())
+			return nil
+		}
+	}
+
+	// An artifact already fetched needs only the space to extract it.
+	dc := cmd.pdcfg.GetDiskConfig()
+	expansion := dc.Expansion
+	if appCfg.DiskExpansion > 0 {
+		expansion = appCfg.DiskExpansion
+	}
+	if dplmt.ArtifactPresent(vers.Name) && expansion > 1 {
+		expansion -= 1
+	}
+	needed := int64(float64(size)*expansion) + dc.Reserve*1024*1024
+
+	free, err := dplmt.FreeSpace()
+	if err != nil {
+		cmd.lw.Warn("Not checking disk space for %q: %s", artifactPath, err.Error())
+		return nil
+	}
+	if free < needed {
+		return fmt.Errorf("not enough disk space: %d MB needed, %d MB free", needed/(1024*1024)+1, free/(1024*1024))
+	}
+	return nil
+}
+
+// lockPIDFile locks a PID file holding the process ID of the daemon, and returns
+// it open; the lock is released when it is closed, or the daemon dies. The file
+// is left in place, as removing it could let a second daemon lock a file that
+// no longer has a name.
+func lockPIDFile(name string) (*os.File, error) {
+	fp, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open PID file: %s", err.Error())
+	}
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer fp.Close()
+		if err == syscall.EWOULDBLOCK {
+			pid, _ := ioutil.ReadAll(fp)
+			return nil, fmt.Errorf("Daemon already running as process %s, according to %q",
+				strings.TrimSpace(string(pid)), name)
+		}
+		return nil, fmt.Errorf("Cannot lock PID file %q: %s", name, err.Error())
+	}
+	fp.Truncate(0)
+	if _, err := fp.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("Cannot write PID file %q: %s", name, err.Error())
+	}
+	return fp, nil
+}
+
+// fetchDelta rebuilds an artifact from the delta against a base version that is
+// already present, verifying the result against the HMAC from the repository.
+func (cmd *Daemon) fetchDelta(dplmt *deployment.Deployment, ri *repo.Index, vers *repo.Version, expectedMAC []byte) error {
+	deltaPath := ri.DeltaPath(vers)
+	delta, err := cmd.stg.GetReader(deltaPath)
+	if err == nil {
+		err = dplmt.WriteDeltaArtifact(vers.Name, vers.Delta.Base, delta, expectedMAC, vers.Digest)
+	}
+	if err != nil {
+		cmd.lw.Warn("Error rebuilding artifact from delta %q; fetching in full: %s", deltaPath, err.Error())
+	}
+	return err
+}
+
+// setStage records the progress of deploying a version in the journal; a failure
+// to do so is only logged, as the version is not reported until it is ready.
+func (cmd *Daemon) setStage(dplmt *deployment.Deployment, appName, version, stage string) {
+	if err := dplmt.SetStage(version, stage); err != nil {
+		cmd.lw.Warn("Error recording deployment of %s in %s, version %q: %s",
+			appName, cmd.appEnv(appName), version, err.Error())
+	}
+}
+
+// fetchPending indicates whether fetching new artifacts for an application must
+// wait out a random delay, and arranges to synchronize again once it is over.
+func (cmd *Daemon) fetchPending(appName string, appCfg *pdconfig.AppConfig,
+	dplmt *deployment.Deployment, versions []string) bool {
+
+	// The application may override the delay configured for the daemon.
+	jitter := cmd.pdcfg.GetSignallerConfig().FetchJitter
+	if appCfg.FetchJitter != 0 {
+		jitter = appCfg.FetchJitter
+	}
+
+	// There is nothing to wait for unless an artifact must be fetched.
+	needFetch := false
+	for _, version := range versions {
+		if !dplmt.ArtifactPresent(version) {
+			needFetch = true
+			break
+		}
+	}
+	if jitter <= 0 || !needFetch {
+		delete(cmd.fetchAfter, appName)
+		return false
+	}
+
+	// Continue waiting out a delay already begun, or proceed once it is over.
+	if deadline, found := cmd.fetchAfter[appName]; found {
+		if time.Now().Before(deadline) {
+			return true
+		}
+		delete(cmd.fetchAfter, appName)
+		return false
+	}
+
+	delay := time.Duration(cmd.rng.Int63n(int64(jitter) * int64(time.Second)))
+	cmd.fetchAfter[appName] = time.Now().Add(delay)
+	cmd.lw.Info("Fetching for %q in %q will start in %s", appName, cmd.appEnv(appName), delay)
+	time.AfterFunc(delay, func() {
+		cmd.delayed <- signaller.Notification{Source: signaller.KNS_DELAYED, Appname: appName}
+	})
+	return true
+}
+
+// runHook executes the command configured for a phase of deploying a version of
+// an application, logging its output as it runs, and returns an error if it failed.
+func (cmd *Daemon) runHook(dplmt *deployment.Deployment, ri *repo.Index,
+	appName, phase, version, previousVersion string) error {
+
+	hc := &deployment.HookContext{
+		PreviousVersion: previousVersion,
+		Metadata:        versionMetadata(ri, version),
+	}
+	output := func(stream, line string) {
+		cmd.lw.Info("%s %s %s: %s", appName, phase, stream, line)
+	}
+	cmdline, err := dplmt.RunHook(phase, version, hc, output)
 	if cmdline != "" {
 		cmd.lw.Info(cmdline)
 	}
 	if err != nil {
-		cmd.lw.Warn(err.Error())
+		cmd.lw.Warn("The %s command FAILED for %s in %s, version %q: %s",
+			phase, appName, cmd.appEnv(appName), version, err.Error())
+		return fmt.Errorf("%s command: %s", phase, err.Error())
+	}
+	return nil
+}
+
+// versionMetadata describes a version from the repository index to the scripts
+// run while deploying it.
+func versionMetadata(ri *repo.Index, version string) map[string]string {
+	metadata := make(map[string]string)
+	if vers, err := ri.GetVersion(version); err == nil {
+		metadata["filename"] = vers.Filename
+		metadata["uploaded"] = vers.TS.UTC().Format(time.RFC3339)
+		metadata["digest"] = vers.Digest
+	}
+	return metadata
+}
+
+// appEnv returns the environment monitored for an application: the one configured
+// for it, or else the one given on the command line, if any.
+func (cmd *Daemon) appEnv(appName string) string {
+	if envName := cmd.pdcfg.GetAppEnv(appName); envName != "" {
+		return envName
+	}
+	return cmd.envName
+}
+
+// register enters the local host into the hosts registry for an application,
+// along with its deployments and any problem with them.
+func (cmd *Daemon) register(appName string, dplmt *deployment.Deployment) {
+	cmd.hr.RegisterHost(signaller.RegistryInfo{
+		Hostname:   cmd.myHostname,
+		Envname:    cmd.appEnv(appName),
+		Appname:    appName,
+		AppVersion: dplmt.GetCurrentLink(),
+		Deployed:   dplmt.GetDeployedVersions(),
+		PeerURL:    cmd.peerURL,
+		Problem:    cmd.problems[appName],
+	})
+}
+
+// isRollback indicates whether a release returns to a version uploaded before
+// the one it replaces.
+func isRollback(ri *repo.Index, fromVersion, toVersion string) bool {
+	from, err := ri.GetVersion(fromVersion)
+	if err != nil {
+		return false
+	}
+	to, err := ri.GetVersion(toVersion)
+	if err != nil {
+		return false
 	}
+	return to.TS.Before(from.TS)
 }
@@ -8,18 +8,20 @@ import (
 	"github.com/mredivo/pulldeploy/storage"
 )
 
-// pulldeploy deploy -app=<app> -version=<version> -env=<env>
+// pulldeploy deploy -app=<app> -version=<version> -env=<env> [-force]
 type Deploy struct {
 	result     *Result
 	pdcfg      pdconfig.PDConfig
 	appName    string
 	appVersion string
 	envName    string
+	force      bool
 }
 
 func (cmd *Deploy) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
 
 	var appName, appVersion, envName string
+	var force bool
 	cmd.result = NewResult(cmdName)
 	cmd.pdcfg = pdcfg
 
@@ -27,6 +29,7 @@ func (cmd *Deploy) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []s
 	cmdFlags.StringVar(&appName, "app", "", "name of the application")
 	cmdFlags.StringVar(&appVersion, "version", "", "version of the application to be deployed")
 	cmdFlags.StringVar(&envName, "env", "", "environment to which to deploy")
+	cmdFlags.BoolVar(&force, "force", false, "deploy even if the environment is locked")
 	cmdFlags.Parse(osArgs)
 
 	if appName == "" {
@@ -47,6 +50,8 @@ func (cmd *Deploy) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []s
 		cmd.envName = envName
 	}
 
+	cmd.force = force
+
 	return cmd.result
 }
 
@@ -71,6 +76,14 @@ func (cmd *Deploy) Exec() *Result {
 	sgnlr.Open()
 	defer sgnlr.Close()
 
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
 	// Retrieve the repository index.
 	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
 
@@ -86,7 +99,7 @@ func (cmd *Deploy) Exec() *Result {
 			return cmd.result
 		} else {
 			// Add this one to the list of deployed versions.
-			if err := env.Deploy(cmd.appVersion); err != nil {
+			if err := env.Deploy(cmd.appVersion, cmd.force); err != nil {
 				cmd.result.AppendError(err)
 				return cmd.result
 			}
@@ -0,0 +1,217 @@
+package command
+
+import (
+	"crypto/hmac"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mredivo/pulldeploy/deployment"
+	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/storage"
+)
+
+// Orphaned files written more recently than this may belong to an upload that
+// has yet to record its version in the index, and are not deleted.
+const kORPHAN_GRACE = 24 * time.Hour
+
+// pulldeploy fsck -app=<app> [-repair]
+type Fsck struct {
+	result  *Result
+	pdcfg   pdconfig.PDConfig
+	appName string
+	repair  bool
+}
+
+func (cmd *Fsck) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
+
+	var appName string
+	var repair bool
+	cmd.result = NewResult(cmdName)
+	cmd.pdcfg = pdcfg
+
+	cmdFlags := flag.NewFlagSet(cmdName, flag.ExitOnError)
+	cmdFlags.StringVar(&appName, "app", "", "name of the application whose repository to check")
+	cmdFlags.BoolVar(&repair, "repair", false, "delete orphaned files and disable broken versions")
+	cmdFlags.Parse(osArgs)
+
+	if appName == "" {
+		cmd.result.Errorf("app is a mandatory argument")
+	} else {
+		cmd.appName = appName
+	}
+
+	cmd.repair = repair
+
+	return cmd.result
+}
+
+func (cmd *Fsck) Exec() *Result {
+
+	// Ensure the app definition exists.
+	appCfg, err := cmd.pdcfg.GetAppConfig(cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Get access to the repo storage.
+	stgcfg := cmd.pdcfg.GetStorageConfig()
+	stg, err := storage.New(storage.AccessMethod(stgcfg.AccessMethod), stgcfg.Params)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Serialize repairs with other updates to the index.
+	if cmd.repair {
+		unlock, err := lockRepoIndex(stg, cmd.appName)
+		if err != nil {
+			cmd.result.AppendError(err)
+			return cmd.result
+		}
+		defer unlock()
+	}
+
+	// Retrieve the repository index.
+	ri, err := getRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Retrieve the listing of the files actually present in storage.
+	files := make(map[string]storage.FileInfo)
+	for _, dirPath := range []string{ri.ArtifactDirPath(), ri.BlobDirPath()} {
+		if list, err := stg.List(dirPath); err == nil {
+			for _, fi := range list {
+				files[fi.Path] = fi
+			}
+		} else {
+			cmd.result.AppendError(err)
+			return cmd.result
+		}
+	}
+
+	var problemCount, repairCount, disabledCount int
+	var problemf = func(format string, a ...interface{}) {
+		problemCount++
+		fmt.Printf("  "+format+"\n", a...)
+	}
+	fmt.Printf("Checking repository for %q\n", cmd.appName)
+
+	// Check that every version has its artifact and a valid HMAC.
+	referenced := make(map[string]bool)
+	hmacCalculator := deployment.NewHMACCalculator(appCfg.Secret)
+	for _, v := range ri.VersionList("asc") {
+
+		artifactPath := ri.VersionPath(&v)
+		hmacPath := ri.VersionHMACPath(&v)
+		referenced[artifactPath] = true
+		referenced[hmacPath] = true
+		if v.Delta != nil {
+			referenced[ri.DeltaPath(&v)] = true
+		}
+
+		// Problems with disabled versions are reported, but are already contained.
+		var issues []string
+		if _, found := files[artifactPath]; !found {
+			issues = append(issues, fmt.Sprintf("artifact %q missing", artifactPath))
+		}
+		if _, found := files[hmacPath]; !found {
+			issues = append(issues, fmt.Sprintf("HMAC %q missing", hmacPath))
+		}
+
+		// Recompute the HMAC, and compare it with the stored one.
+		if len(issues) == 0 {
+			if expectedMAC, err := stg.Get(hmacPath); err != nil {
+				issues = append(issues, fmt.Sprintf("error reading HMAC %q: %s", hmacPath, err.Error()))
+			} else if rc, err := stg.GetReader(artifactPath); err != nil {
+				issues = append(issues, fmt.Sprintf("error reading artifact %q: %s", artifactPath, err.Error()))
+			} else if messageMAC := deployment.CalculateHMAC(rc, hmacCalculator); !hmac.Equal(messageMAC, expectedMAC) {
+				issues = append(issues, fmt.Sprintf("HMAC mismatch for artifact %q", artifactPath))
+			}
+		}
+		for _, issue := range issues {
+			if v.Enabled {
+				problemf("version %q: %s", v.Name, issue)
+			} else {
+				fmt.Printf("  version %q (disabled): %s\n", v.Name, issue)
+			}
+		}
+
+		// Broken versions are disabled, so they cannot be released.
+		if len(issues) > 0 && v.Enabled && cmd.repair {
+			if vers, err := ri.GetVersion(v.Name); err == nil {
+				vers.Disable()
+				disabledCount++
+				repairCount += len(issues)
+				fmt.Printf("    version %q disabled\n", v.Name)
+			}
+		}
+	}
+
+	// Check that every version referenced by an environment is present.
+	var envNames []string
+	for envName := range ri.Envs {
+		envNames = append(envNames, envName)
+	}
+	sort.Strings(envNames)
+	for _, envName := range envNames {
+		env, _ := ri.GetEnv(envName)
+		refs := []string{env.Current, env.Prior, env.Preview}
+		for _, histEvent := range env.Deployed {
+			refs = append(refs, histEvent.Version)
+		}
+		seen := make(map[string]bool)
+		for _, versionName := range refs {
+			if versionName == "" || seen[versionName] {
+				continue
+			}
+			seen[versionName] = true
+			if _, err := ri.GetVersion(versionName); err != nil {
+				problemf("environment %q: version %q referenced but not present", envName, versionName)
+			}
+		}
+	}
+
+	// Check for files in storage that no version refers to.
+	var orphans []string
+	for repoPath := range files {
+		if !referenced[repoPath] {
+			orphans = append(orphans, repoPath)
+		}
+	}
+	sort.Strings(orphans)
+	for _, repoPath := range orphans {
+		problemf("orphaned file %q (%d bytes)", repoPath, files[repoPath].Size)
+		if cmd.repair && time.Since(files[repoPath].ModTime) < kORPHAN_GRACE {
+			fmt.Printf("    %q kept: written within the last %s, perhaps by an upload in progress\n",
+				repoPath, kORPHAN_GRACE)
+		} else if cmd.repair {
+			if err := stg.Delete(repoPath); err == nil {
+				repairCount++
+				fmt.Printf("    %q deleted\n", repoPath)
+			} else {
+				fmt.Printf("    error deleting %q: %s\n", repoPath, err.Error())
+			}
+		}
+	}
+
+	// Write the index back if any versions were disabled.
+	if disabledCount > 0 {
+		if err := setRepoIndex(stg, ri); err != nil {
+			cmd.result.AppendError(err)
+			return cmd.result
+		}
+	}
+
+	if problemCount > repairCount {
+		cmd.result.Errorf("%d problem(s) found, %d repaired", problemCount, repairCount)
+	} else {
+		cmd.result.Messagef("%d problem(s) found, %d repaired", problemCount, repairCount)
+	}
+
+	return cmd.result
+}
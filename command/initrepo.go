@@ -50,6 +50,14 @@ func (cmd *Initrepo) Exec() *Result {
 		return cmd.result
 	}
 
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
 	// Do not overwrite an existing index.
 	if _, err := getRepoIndex(stg, cmd.appName); err == nil {
 		cmd.result.Errorf("repository already initialized, no action taken")
@@ -62,6 +62,9 @@ func (cmd *Listhosts) Exec() *Result {
 	var count int
 	for _, v := range hr.Hosts(cmd.envName, cmd.appName) {
 		fmt.Printf("   Host: %q Version: %q Deployed: %v\n", v.Hostname, v.AppVersion, strings.Join(v.Deployed, ", "))
+		if v.Problem != "" {
+			fmt.Printf("      Problem: %s\n", v.Problem)
+		}
 		count++
 	}
 	if count == 1 {
@@ -0,0 +1,120 @@
+package command
+
+import (
+	"flag"
+
+	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/storage"
+)
+
+// pulldeploy lock -app=<app> -env=<env> -reason=<reason> [-schedule=<cron> -duration=<duration>]
+type Lock struct {
+	result   *Result
+	pdcfg    pdconfig.PDConfig
+	appName  string
+	envName  string
+	reason   string
+	schedule string
+	duration string
+}
+
+func (cmd *Lock) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
+
+	var appName, envName, reason, schedule, duration string
+	cmd.result = NewResult(cmdName)
+	cmd.pdcfg = pdcfg
+
+	cmdFlags := flag.NewFlagSet(cmdName, flag.ExitOnError)
+	cmdFlags.StringVar(&appName, "app", "", "name of the application")
+	cmdFlags.StringVar(&envName, "env", "", "environment to lock")
+	cmdFlags.StringVar(&reason, "reason", "", "why the environment is being locked")
+	cmdFlags.StringVar(&schedule, "schedule", "", "recurring freeze window start, in cron format")
+	cmdFlags.StringVar(&duration, "duration", "", "length of the recurring freeze window, for example \"48h\"")
+	cmdFlags.Parse(osArgs)
+
+	if appName == "" {
+		cmd.result.Errorf("app is a mandatory argument")
+	} else {
+		cmd.appName = appName
+	}
+
+	if envName == "" {
+		cmd.result.Errorf("env is a mandatory argument")
+	} else {
+		cmd.envName = envName
+	}
+
+	if reason == "" {
+		cmd.result.Errorf("reason is a mandatory argument")
+	} else {
+		cmd.reason = reason
+	}
+
+	if (schedule == "") != (duration == "") {
+		cmd.result.Errorf("schedule and duration must be specified together")
+	} else {
+		cmd.schedule = schedule
+		cmd.duration = duration
+	}
+
+	return cmd.result
+}
+
+func (cmd *Lock) Exec() *Result {
+
+	// Ensure the app definition exists.
+	if _, err := cmd.pdcfg.GetAppConfig(cmd.appName); err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Get access to the repo storage.
+	stgcfg := cmd.pdcfg.GetStorageConfig()
+	stg, err := storage.New(storage.AccessMethod(stgcfg.AccessMethod), stgcfg.Params)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
+	// Retrieve the repository index.
+	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
+
+		// Retrieve and update the environment.
+		if env, err := ri.GetEnv(cmd.envName); err != nil {
+			cmd.result.AppendError(err)
+			return cmd.result
+		} else {
+			// Either lock it now, or add a recurring freeze window.
+			if cmd.schedule == "" {
+				err = env.SetLock(getUserName(), cmd.reason)
+			} else {
+				err = env.AddFreeze(cmd.schedule, cmd.duration, getUserName(), cmd.reason)
+			}
+			if err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+			if err := ri.SetEnv(cmd.envName, env); err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+		}
+
+		// Write the index back.
+		if err := setRepoIndex(stg, ri); err != nil {
+			cmd.result.AppendError(err)
+		}
+	} else {
+		cmd.result.AppendError(err)
+	}
+
+	return cmd.result
+}
@@ -0,0 +1,282 @@
+package command
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/repo"
+	"github.com/mredivo/pulldeploy/storage"
+)
+
+// pulldeploy mirror -to=<accessmethod> [-from=<accessmethod>] [-app=<app>] [-prune] [-watch [-interval=<duration>]]
+type Mirror struct {
+	result   *Result
+	pdcfg    pdconfig.PDConfig
+	from     string
+	to       string
+	appName  string
+	prune    bool
+	watch    bool
+	interval time.Duration
+}
+
+// mirrorStats counts the work done in one pass.
+type mirrorStats struct {
+	apps, copied, skipped, pruned int
+	bytes                         int64
+}
+
+func (cmd *Mirror) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
+
+	var from, to, appName string
+	var prune, watch bool
+	var interval time.Duration
+	cmd.result = NewResult(cmdName)
+	cmd.pdcfg = pdcfg
+
+	cmdFlags := flag.NewFlagSet(cmdName, flag.ExitOnError)
+	cmdFlags.StringVar(&from, "from", pdcfg.GetStorageConfig().AccessMethod, "access method of the repository to copy from")
+	cmdFlags.StringVar(&to, "to", "", "access method of the repository to copy to")
+	cmdFlags.StringVar(&appName, "app", "", "name of the application to mirror (default all)")
+	cmdFlags.BoolVar(&prune, "prune", false, "delete artifacts no longer in the source repository")
+	cmdFlags.BoolVar(&watch, "watch", false, "keep mirroring until interrupted")
+	cmdFlags.DurationVar(&interval, "interval", time.Minute, "time between passes in watch mode")
+	cmdFlags.Parse(osArgs)
+
+	if to == "" {
+		cmd.result.Errorf("to is a mandatory argument")
+	} else if to == from {
+		cmd.result.Errorf("from and to must be different access methods")
+	}
+	cmd.from = from
+	cmd.to = to
+	cmd.appName = appName
+	cmd.prune = prune
+	cmd.watch = watch
+
+	if interval < time.Second {
+		cmd.result.Errorf("interval must be at least 1s")
+	} else {
+		cmd.interval = interval
+	}
+
+	return cmd.result
+}
+
+func (cmd *Mirror) Exec() *Result {
+
+	// Get access to both repositories.
+	src, err := cmd.openStorage(cmd.from)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	dst, err := cmd.openStorage(cmd.to)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Make a single pass, unless asked to keep watching.
+	if !cmd.watch {
+		stats, errs := cmd.mirror(src, dst)
+		for _, err := range errs {
+			cmd.result.AppendError(err)
+		}
+		cmd.result.Messagef("%d application(s): %d file(s) copied (%d bytes), %d already present, %d pruned",
+			stats.apps, stats.copied, stats.bytes, stats.skipped, stats.pruned)
+		return cmd.result
+	}
+
+	// In watch mode, errors are reported and retried on the next pass.
+	var sigterm = make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(cmd.interval)
+	defer ticker.Stop()
+	for {
+		stats, errs := cmd.mirror(src, dst)
+		for _, err := range errs {
+			fmt.Println(err.Error())
+		}
+		if stats.copied > 0 || stats.pruned > 0 || len(errs) > 0 {
+			fmt.Printf("%s %d application(s): %d file(s) copied (%d bytes), %d pruned, %d error(s)\n",
+				time.Now().Format("2006-01-02 15:04:05"), stats.apps, stats.copied, stats.bytes, stats.pruned, len(errs))
+		}
+		select {
+		case <-ticker.C:
+		case <-sigterm:
+			cmd.result.Messagef("mirroring stopped")
+			return cmd.result
+		}
+	}
+}
+
+// openStorage gets access to the repository with the given access method.
+func (cmd *Mirror) openStorage(accessMethod string) (storage.Storage, error) {
+	stgcfg, err := cmd.pdcfg.GetStorageConfigByMethod(accessMethod)
+	if err != nil {
+		return nil, err
+	}
+	return storage.New(storage.AccessMethod(stgcfg.AccessMethod), stgcfg.Params)
+}
+
+// mirror makes one pass over the applications in the source repository.
+func (cmd *Mirror) mirror(src, dst storage.Storage) (mirrorStats, []error) {
+
+	var stats mirrorStats
+	var errs []error = make([]error, 0)
+
+	// Determine which applications to copy.
+	appNames := []string{cmd.appName}
+	if cmd.appName == "" {
+		var err error
+		if appNames, err = findApps(src); err != nil {
+			return stats, append(errs, err)
+		}
+	}
+
+	for _, appName := range appNames {
+		if err := cmd.mirrorApp(appName, src, dst, &stats); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", appName, err.Error()))
+		}
+		stats.apps++
+	}
+
+	return stats, errs
+}
+
+// mirrorApp copies the artifacts and HMACs of one application, then its index.
+// The index is written last, so that it never refers to an artifact that
+// has not yet been copied.
+func (cmd *Mirror) mirrorApp(appName string, src, dst storage.Storage, stats *mirrorStats) error {
+
+	// Retrieve the source index.
+	ri := repo.NewIndex(appName)
+	indexText, err := src.Get(ri.IndexPath())
+	if err != nil {
+		return err
+	}
+	if err := ri.FromJSON(indexText); err != nil {
+		return err
+	}
+
+	// Copy each version that is missing or different.
+	referenced := make(map[string]bool)
+	for _, v := range ri.VersionList("asc") {
+
+		artifactPath := ri.VersionPath(&v)
+		hmacPath := ri.VersionHMACPath(&v)
+		referenced[artifactPath] = true
+		referenced[hmacPath] = true
+
+		// A delta is named for its base, so one already present is the same delta.
+		if v.Delta != nil {
+			deltaPath := ri.DeltaPath(&v)
+			referenced[deltaPath] = true
+			if srcInfo, err := src.Stat(deltaPath); err == nil {
+				if dstInfo, err := dst.Stat(deltaPath); err != nil || dstInfo.Size != srcInfo.Size {
+					if err := copyRepoFile(src, dst, deltaPath, srcInfo.Size); err != nil {
+						return err
+					}
+					stats.copied++
+					stats.bytes += srcInfo.Size
+				}
+			}
+		}
+
+		// Matching size and HMAC means the artifact is already present.
+		srcHMAC, err := src.Get(hmacPath)
+		if err != nil {
+			return err
+		}
+		srcInfo, err := src.Stat(artifactPath)
+		if err != nil {
+			return err
+		}
+		if dstInfo, err := dst.Stat(artifactPath); err == nil && dstInfo.Size == srcInfo.Size {
+			if dstHMAC, err := dst.Get(hmacPath); err == nil && bytes.Equal(dstHMAC, srcHMAC) {
+				stats.skipped++
+				continue
+			}
+		}
+
+		// Copy the artifact, then its HMAC.
+		if err := copyRepoFile(src, dst, artifactPath, srcInfo.Size); err != nil {
+			return err
+		}
+		if err := dst.Put(hmacPath, srcHMAC); err != nil {
+			return err
+		}
+		stats.copied++
+		stats.bytes += srcInfo.Size
+	}
+
+	// Write the index last, if it has changed.
+	if dstText, err := dst.Get(ri.IndexPath()); err != nil || !bytes.Equal(dstText, indexText) {
+		unlock, err := lockRepoIndex(dst, appName)
+		if err != nil {
+			return err
+		}
+		err = dst.Put(ri.IndexPath(), indexText)
+		unlock()
+		if err != nil {
+			return err
+		}
+		stats.copied++
+		stats.bytes += int64(len(indexText))
+	}
+
+	// Remove what the source no longer has, now that the index no longer refers to it.
+	if cmd.prune {
+		for _, dirPath := range []string{ri.ArtifactDirPath(), ri.BlobDirPath()} {
+			list, err := dst.List(dirPath)
+			if err != nil {
+				return err
+			}
+			for _, fi := range list {
+				if !referenced[fi.Path] {
+					if err := dst.Delete(fi.Path); err != nil {
+						return err
+					}
+					stats.pruned++
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Utility helper to copy a file of a known size from one repository to another.
+func copyRepoFile(src, dst storage.Storage, repoPath string, size int64) error {
+	rc, err := src.GetReader(repoPath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return dst.PutMultipart(repoPath, rc, size, kDEFAULT_PART_SIZE_MB*1024*1024)
+}
+
+// Utility helper to find the applications with an index in a repository.
+func findApps(stg storage.Storage) ([]string, error) {
+	list, err := stg.List("")
+	if err != nil {
+		return nil, err
+	}
+	appNames := make([]string, 0)
+	for _, fi := range list {
+		if parts := strings.Split(fi.Path, "/"); len(parts) == 2 && fi.Path == repo.NewIndex(parts[0]).IndexPath() {
+			appNames = append(appNames, parts[0])
+		}
+	}
+	sort.Strings(appNames)
+	return appNames, nil
+}
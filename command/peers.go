@@ -0,0 +1,187 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mredivo/pulldeploy/deployment"
+	"github.com/mredivo/pulldeploy/logging"
+	"github.com/mredivo/pulldeploy/pdconfig"
+)
+
+/*
+Daemons in an environment can share artifacts, so that a release to many hosts
+does not have every host fetch the same artifact from the repository at once.
+
+A daemon that serves its peers listens for requests of the form:
+
+	GET /artifacts/<app>/<version>
+
+and responds with the artifact, if it holds one that it has already verified;
+it registers the URL at which it does so in the hosts registry. A daemon that
+needs an artifact tries a few of the peers registered as having deployed that
+version before falling back to the repository. Whatever the source, the artifact
+must match the HMAC from the repository, which remains the trust anchor.
+
+Encrypted artifacts are never shared, as the repository HMAC covers only their
+encrypted form, and peers hold only the plaintext.
+*/
+const kPEER_PATH_PREFIX = "/artifacts/"
+
+// How long to wait for a peer to begin responding.
+const kPEER_RESPONSE_TIMEOUT = 10 * time.Second
+
+// The client used for all requests to peers.
+var peerClient = &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: kPEER_RESPONSE_TIMEOUT}}
+
+// peerServer serves verified artifacts to other daemons.
+type peerServer struct {
+	pdcfg pdconfig.PDConfig
+	token string
+	lw    *logging.Writer
+}
+
+// startPeerServer begins serving artifacts to peers in the background, and
+// returns the listener, along with the URL at which peers reach it.
+func startPeerServer(pdcfg pdconfig.PDConfig, lw *logging.Writer, hostname string) (net.Listener, string, error) {
+
+	pc := pdcfg.GetPeerConfig()
+	listener, err := net.Listen("tcp", pc.Listen)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to serve artifacts to peers: %s", err.Error())
+	}
+
+	// Unless told otherwise, peers reach this host by name.
+	peerURL := strings.TrimSuffix(pc.Advertise, "/")
+	if peerURL == "" {
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+		peerURL = "http://" + net.JoinHostPort(hostname, port)
+	}
+
+	ps := &peerServer{pdcfg, pc.Token, lw}
+	go http.Serve(listener, ps)
+
+	return listener, peerURL, nil
+}
+
+// ServeHTTP responds to a request for an artifact.
+func (ps *peerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ps.token != "" && r.Header.Get("Authorization") != "Bearer "+ps.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Only the artifacts of configured, unencrypted applications are served.
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, kPEER_PATH_PREFIX), "/")
+	if !strings.HasPrefix(r.URL.Path, kPEER_PATH_PREFIX) || len(parts) != 2 ||
+		parts[1] == "" || strings.HasPrefix(parts[1], ".") {
+		http.NotFound(w, r)
+		return
+	}
+	appName, version := parts[0], parts[1]
+	appCfg, err := ps.pdcfg.GetAppConfig(appName)
+	if err != nil || appCfg.EncryptionKey != "" || appCfg.EncryptionKeyFile != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// An application that was never deployed here has no artifacts, and its
+	// directories are not to be created on behalf of a peer.
+	if _, err := os.Stat(path.Join(appCfg.BaseDir, appName)); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	dplmt, err := deployment.New(appName, ps.pdcfg, appCfg)
+	if err != nil {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fp, err := dplmt.OpenArtifact(version)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	ps.lw.Debug("Serving artifact for %s version %q to peer %s", appName, version, r.RemoteAddr)
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), fp)
+}
+
+// fetchFromPeers writes an artifact fetched from one of the peers that have
+// deployed the version, verifying it against the HMAC from the repository.
+func (cmd *Daemon) fetchFromPeers(dplmt *deployment.Deployment, appName, version string,
+	expectedMAC []byte, digest string) error {
+
+	// Find the peers that should have the artifact, in random order to spread the load.
+	var peerURLs []string
+	for _, host := range cmd.hr.Hosts(cmd.appEnv(appName), appName) {
+		if host.PeerURL == "" || host.PeerURL == cmd.peerURL || host.Hostname == cmd.myHostname {
+			continue
+		}
+		for _, v := range host.Deployed {
+			if v == version {
+				peerURLs = append(peerURLs, host.PeerURL)
+				break
+			}
+		}
+	}
+	if len(peerURLs) == 0 {
+		return fmt.Errorf("No peer has deployed %s version %q", appName, version)
+	}
+	maxPeers := cmd.pdcfg.GetPeerConfig().MaxPeers
+	for i, j := range cmd.rng.Perm(len(peerURLs)) {
+		if i >= maxPeers {
+			break
+		}
+		if err := cmd.fetchFromPeer(dplmt, peerURLs[j], appName, version, expectedMAC, digest); err == nil {
+			cmd.lw.Debug("Fetched artifact for %s version %q from peer %s", appName, version, peerURLs[j])
+			return nil
+		} else {
+			cmd.lw.Warn("Error fetching artifact for %s version %q from peer %s: %s",
+				appName, version, peerURLs[j], err.Error())
+		}
+	}
+
+	return fmt.Errorf("No peer supplied %s version %q", appName, version)
+}
+
+// fetchFromPeer writes an artifact fetched from a single peer.
+func (cmd *Daemon) fetchFromPeer(dplmt *deployment.Deployment, peerURL, appName, version string,
+	expectedMAC []byte, digest string) error {
+
+	req, err := http.NewRequest("GET", peerURL+kPEER_PATH_PREFIX+appName+"/"+version, nil)
+	if err != nil {
+		return err
+	}
+	if token := cmd.pdcfg.GetPeerConfig().Token; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	return dplmt.WriteVerifiedArtifact(version, resp.Body, expectedMAC, digest)
+}
@@ -8,19 +8,21 @@ import (
 	"github.com/mredivo/pulldeploy/storage"
 )
 
-// pulldeploy release -app=<app> -version=<version> -env=<env> [host1, host2, ...]
+// pulldeploy release -app=<app> -version=<version> -env=<env> [-force] [host1, host2, ...]
 type Release struct {
 	result     *Result
 	pdcfg      pdconfig.PDConfig
 	appName    string
 	appVersion string
 	envName    string
+	force      bool
 	hosts      []string
 }
 
 func (cmd *Release) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
 
 	var appName, appVersion, envName string
+	var force bool
 	cmd.result = NewResult(cmdName)
 	cmd.pdcfg = pdcfg
 
@@ -28,6 +30,7 @@ func (cmd *Release) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []
 	cmdFlags.StringVar(&appName, "app", "", "name of the application")
 	cmdFlags.StringVar(&appVersion, "version", "", "version of the application to be released")
 	cmdFlags.StringVar(&envName, "env", "", "environment in which to release")
+	cmdFlags.BoolVar(&force, "force", false, "release even if the environment is locked")
 	cmdFlags.Parse(osArgs)
 
 	if appName == "" {
@@ -48,6 +51,7 @@ func (cmd *Release) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []
 		cmd.envName = envName
 	}
 
+	cmd.force = force
 	cmd.hosts = cmdFlags.Args()
 
 	return cmd.result
@@ -74,6 +78,14 @@ func (cmd *Release) Exec() *Result {
 	sgnlr.Open()
 	defer sgnlr.Close()
 
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
 	// Retrieve the repository index.
 	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
 
@@ -84,7 +96,7 @@ func (cmd *Release) Exec() *Result {
 		} else {
 
 			// Indicate that this is the currently active version.
-			if err := env.Release(cmd.appVersion, cmd.hosts); err != nil {
+			if err := env.Release(cmd.appVersion, cmd.hosts, getUserName(), cmd.force); err != nil {
 				cmd.result.AppendError(err)
 				return cmd.result
 			}
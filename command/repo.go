@@ -0,0 +1,114 @@
+package command
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/storage"
+)
+
+// pulldeploy repo ls [-app=<app>]
+type Repo struct {
+	result  *Result
+	pdcfg   pdconfig.PDConfig
+	subCmd  string
+	appName string
+}
+
+func (cmd *Repo) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
+
+	var appName string
+	cmd.result = NewResult(cmdName)
+	cmd.pdcfg = pdcfg
+
+	// The first argument selects the repo operation.
+	if len(osArgs) < 1 {
+		cmd.result.Errorf("a repo subcommand is mandatory")
+		return cmd.result
+	}
+	cmd.subCmd = osArgs[0]
+
+	switch cmd.subCmd {
+	case "ls":
+		cmdFlags := flag.NewFlagSet(cmdName+" "+cmd.subCmd, flag.ExitOnError)
+		cmdFlags.StringVar(&appName, "app", "", "name of the application to list (default all)")
+		cmdFlags.Parse(osArgs[1:])
+		cmd.appName = appName
+	default:
+		cmd.result.Errorf("invalid repo subcommand: %q", cmd.subCmd)
+	}
+
+	return cmd.result
+}
+
+func (cmd *Repo) Exec() *Result {
+
+	// Get access to the repo storage.
+	stgcfg := cmd.pdcfg.GetStorageConfig()
+	stg, err := storage.New(storage.AccessMethod(stgcfg.AccessMethod), stgcfg.Params)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	switch cmd.subCmd {
+	case "ls":
+		cmd.list(stg)
+	}
+
+	return cmd.result
+}
+
+// list shows every file actually present in storage, grouped by application.
+func (cmd *Repo) list(stg storage.Storage) {
+
+	// Retrieve the listing, for one application or all of them.
+	prefix := ""
+	if cmd.appName != "" {
+		prefix = cmd.appName + "/"
+	}
+	list, err := stg.List(prefix)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return
+	}
+
+	// Group the files by application, which is the first element of the path.
+	apps := make(map[string][]storage.FileInfo)
+	for _, fi := range list {
+		if i := strings.Index(fi.Path, "/"); i > 0 {
+			apps[fi.Path[:i]] = append(apps[fi.Path[:i]], fi)
+		}
+	}
+	var appNames []string
+	for appName := range apps {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+
+	// Print each application's files, in alphabetical order.
+	var totalFiles int
+	var totalSize int64
+	for _, appName := range appNames {
+
+		files := apps[appName]
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+		fmt.Printf("%s\n", appName)
+		var appSize int64
+		for _, fi := range files {
+			fmt.Printf("    %-56s %12d  %s\n", strings.TrimPrefix(fi.Path, appName+"/"), fi.Size,
+				fi.ModTime.Format("2006-01-02 15:04:05"))
+			appSize += fi.Size
+		}
+		fmt.Printf("  %d file(s), %d bytes\n", len(files), appSize)
+
+		totalFiles += len(files)
+		totalSize += appSize
+	}
+
+	cmd.result.Messagef("%d application(s), %d file(s), %d bytes", len(appNames), totalFiles, totalSize)
+}
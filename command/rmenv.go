@@ -56,6 +56,14 @@ func (cmd *Rmenv) Exec() *Result {
 		return cmd.result
 	}
 
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
 	// Retrieve the repository index and update it.
 	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
 
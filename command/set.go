@@ -7,19 +7,22 @@ import (
 	"github.com/mredivo/pulldeploy/storage"
 )
 
-// pulldeploy set -app=<app> [-keep=n]
+// pulldeploy set -app=<app> -env=<env> [-keep=n] [-approvals=n] [-approvalttl=<duration>]
 type Set struct {
-	result  *Result
-	pdcfg   pdconfig.PDConfig
-	appName string
-	envName string
-	keep    int
+	result      *Result
+	pdcfg       pdconfig.PDConfig
+	appName     string
+	envName     string
+	keep        int
+	approvals   int
+	approvalTTL string
+	given       map[string]bool
 }
 
 func (cmd *Set) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
 
-	var appName, envName string
-	var keep int
+	var appName, envName, approvalTTL string
+	var keep, approvals int
 	cmd.result = NewResult(cmdName)
 	cmd.pdcfg = pdcfg
 
@@ -27,8 +30,17 @@ func (cmd *Set) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []stri
 	cmdFlags.StringVar(&appName, "app", "", "name of the application whose repository to update")
 	cmdFlags.StringVar(&envName, "env", "", "environment to update")
 	cmdFlags.IntVar(&keep, "keep", 5, "the number of versions of app to keep in the environment")
+	cmdFlags.IntVar(&approvals, "approvals", 0, "the number of approvals required to release in the environment")
+	cmdFlags.StringVar(&approvalTTL, "approvalttl", "", "how long a release request remains valid, for example \"24h\"")
 	cmdFlags.Parse(osArgs)
 
+	// Note which settings were given; keep is updated when no others are.
+	cmd.given = make(map[string]bool)
+	cmdFlags.Visit(func(f *flag.Flag) { cmd.given[f.Name] = true })
+	if !cmd.given["approvals"] && !cmd.given["approvalttl"] {
+		cmd.given["keep"] = true
+	}
+
 	if appName == "" {
 		cmd.result.Errorf("app is a mandatory argument")
 	} else {
@@ -47,6 +59,14 @@ func (cmd *Set) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []stri
 		cmd.keep = keep
 	}
 
+	if approvals < 0 {
+		cmd.result.Errorf("approvals may not be negative")
+	} else {
+		cmd.approvals = approvals
+	}
+
+	cmd.approvalTTL = approvalTTL
+
 	return cmd.result
 }
 
@@ -66,6 +86,14 @@ func (cmd *Set) Exec() *Result {
 		return cmd.result
 	}
 
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
 	// Retrieve the repository index.
 	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
 
@@ -74,7 +102,21 @@ func (cmd *Set) Exec() *Result {
 			cmd.result.AppendError(err)
 			return cmd.result
 		} else {
-			env.SetKeep(cmd.keep)
+			if cmd.given["keep"] {
+				env.SetKeep(cmd.keep)
+			}
+			if cmd.given["approvals"] {
+				if err := env.SetApprovalsRequired(cmd.approvals); err != nil {
+					cmd.result.AppendError(err)
+					return cmd.result
+				}
+			}
+			if cmd.given["approvalttl"] {
+				if err := env.SetApprovalTTL(cmd.approvalTTL); err != nil {
+					cmd.result.AppendError(err)
+					return cmd.result
+				}
+			}
 			if err := ri.SetEnv(cmd.envName, env); err != nil {
 				cmd.result.AppendError(err)
 				return cmd.result
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/mredivo/pulldeploy/pdconfig"
@@ -81,6 +82,49 @@ func (cmd *Status) Exec() *Result {
 				fmt.Printf("    Keep: %2d Current Version: %q Prior Version: %q\n",
 					v.Keep, v.Current, v.Prior)
 			}
+			if v.Lock != nil {
+				fmt.Printf("    LOCKED by %s on %s: %s\n",
+					v.Lock.Holder, v.Lock.TS.Format(time.RFC1123), v.Lock.Reason)
+			}
+			if len(v.Freezes) > 0 {
+				fmt.Printf("    Freeze Windows:\n")
+				for _, fw := range v.Freezes {
+					active := ""
+					if fw.ActiveAt(time.Now()) {
+						active = "  ACTIVE"
+					}
+					fmt.Printf("      %q for %s by %s: %s%s\n", fw.Schedule, fw.Duration, fw.Holder, fw.Reason, active)
+				}
+			}
+			if v.ApprovalsRequired > 0 {
+				ttl := v.ApprovalTTL
+				if ttl == "" {
+					ttl = "default"
+				}
+				fmt.Printf("    Approvals Required: %d  Approval TTL: %s\n", v.ApprovalsRequired, ttl)
+			}
+			if len(v.Requests) > 0 {
+				fmt.Printf("    Pending Release Requests:\n")
+				for _, req := range v.Requests {
+					hosts := ""
+					if len(req.Previewers) > 0 {
+						hosts = " to " + strings.Join(req.Previewers, ", ")
+					}
+					fmt.Printf("      %s%s by %s on %s  Approved by: %s\n", req.Version, hosts,
+						req.Requester, req.TS.Format(time.RFC1123), strings.Join(req.Approvers, ", "))
+				}
+			}
+			if len(v.Approvals) > 0 {
+				fmt.Printf("    Approval History:\n")
+				for _, ae := range v.Approvals {
+					comment := ""
+					if ae.Comment != "" {
+						comment = ": " + ae.Comment
+					}
+					fmt.Printf("      %s %s by %s on %s%s\n", ae.Version, ae.Action, ae.User,
+						ae.TS.Format(time.RFC1123), comment)
+				}
+			}
 			if len(v.Deployed) > 0 {
 				fmt.Printf("    Deploy History:\n")
 				for _, histEvent := range v.Deployed {
@@ -0,0 +1,105 @@
+package command
+
+import (
+	"flag"
+
+	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/storage"
+)
+
+// pulldeploy unlock -app=<app> -env=<env> [-schedule=<cron>]
+type Unlock struct {
+	result   *Result
+	pdcfg    pdconfig.PDConfig
+	appName  string
+	envName  string
+	schedule string
+}
+
+func (cmd *Unlock) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
+
+	var appName, envName, schedule string
+	cmd.result = NewResult(cmdName)
+	cmd.pdcfg = pdcfg
+
+	cmdFlags := flag.NewFlagSet(cmdName, flag.ExitOnError)
+	cmdFlags.StringVar(&appName, "app", "", "name of the application")
+	cmdFlags.StringVar(&envName, "env", "", "environment to unlock")
+	cmdFlags.StringVar(&schedule, "schedule", "", "recurring freeze window to remove, in cron format")
+	cmdFlags.Parse(osArgs)
+
+	if appName == "" {
+		cmd.result.Errorf("app is a mandatory argument")
+	} else {
+		cmd.appName = appName
+	}
+
+	if envName == "" {
+		cmd.result.Errorf("env is a mandatory argument")
+	} else {
+		cmd.envName = envName
+	}
+
+	cmd.schedule = schedule
+
+	return cmd.result
+}
+
+func (cmd *Unlock) Exec() *Result {
+
+	// Ensure the app definition exists.
+	if _, err := cmd.pdcfg.GetAppConfig(cmd.appName); err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Get access to the repo storage.
+	stgcfg := cmd.pdcfg.GetStorageConfig()
+	stg, err := storage.New(storage.AccessMethod(stgcfg.AccessMethod), stgcfg.Params)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+
+	// Serialize updates to the index with other users of the repository.
+	unlock, err := lockRepoIndex(stg, cmd.appName)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	defer unlock()
+
+	// Retrieve the repository index.
+	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
+
+		// Retrieve and update the environment.
+		if env, err := ri.GetEnv(cmd.envName); err != nil {
+			cmd.result.AppendError(err)
+			return cmd.result
+		} else {
+			// Either remove the lock, or remove a recurring freeze window.
+			if cmd.schedule == "" {
+				err = env.ClearLock()
+			} else {
+				err = env.RmFreeze(cmd.schedule)
+			}
+			if err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+			if err := ri.SetEnv(cmd.envName, env); err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+		}
+
+		// Write the index back.
+		if err := setRepoIndex(stg, ri); err != nil {
+			cmd.result.AppendError(err)
+		}
+	} else {
+		cmd.result.AppendError(err)
+	}
+
+	return cmd.result
+}
@@ -1,35 +1,49 @@
 package command
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/mredivo/pulldeploy/deployment"
 	"github.com/mredivo/pulldeploy/pdconfig"
+	"github.com/mredivo/pulldeploy/repo"
 	"github.com/mredivo/pulldeploy/storage"
 )
 
-// pulldeploy upload -app=<app> -version=<version> [-disabled] <file>
+// The default size of the parts in which artifacts are uploaded, in MB.
+const kDEFAULT_PART_SIZE_MB = 64
+
+// pulldeploy upload -app=<app> -version=<version> [-base=<version>] [-disabled] [-partsize=<MB>] <file>
 type Upload struct {
-	result     *Result
-	pdcfg      pdconfig.PDConfig
-	appName    string
-	appVersion string
-	disabled   bool
-	filename   string
+	result      *Result
+	pdcfg       pdconfig.PDConfig
+	appName     string
+	appVersion  string
+	baseVersion string
+	disabled    bool
+	partSize    int64
+	filename    string
 }
 
 func (cmd *Upload) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []string) *Result {
 
-	var appName, appVersion string
+	var appName, appVersion, baseVersion string
 	var disabled bool
+	var partSize int
 	cmd.result = NewResult(cmdName)
 	cmd.pdcfg = pdcfg
 
 	cmdFlags := flag.NewFlagSet(cmdName, flag.ExitOnError)
 	cmdFlags.StringVar(&appName, "app", "", "name of the application")
 	cmdFlags.StringVar(&appVersion, "version", "", "version of the application being uploaded")
+	cmdFlags.StringVar(&baseVersion, "base", "", "earlier version against which to store a delta")
 	cmdFlags.BoolVar(&disabled, "disabled", false, "upload in disabled state")
+	cmdFlags.IntVar(&partSize, "partsize", kDEFAULT_PART_SIZE_MB, "size in MB of the parts in which to upload")
 	cmdFlags.Parse(osArgs)
 
 	if appName == "" {
@@ -44,8 +58,20 @@ func (cmd *Upload) CheckArgs(cmdName string, pdcfg pdconfig.PDConfig, osArgs []s
 		cmd.appVersion = appVersion
 	}
 
+	if baseVersion != "" && baseVersion == appVersion {
+		cmd.result.Errorf("base must be an earlier version")
+	} else {
+		cmd.baseVersion = baseVersion
+	}
+
 	cmd.disabled = disabled
 
+	if partSize < 1 {
+		cmd.result.Errorf("partsize must be at least 1 MB")
+	} else {
+		cmd.partSize = int64(partSize) * 1024 * 1024
+	}
+
 	if len(cmdFlags.Args()) < 1 {
 		cmd.result.Errorf("filename is a mandatory argument")
 	} else if len(cmdFlags.Args()) > 1 {
@@ -83,9 +109,41 @@ func (cmd *Upload) Exec() *Result {
 		return cmd.result
 	}
 
+	// Artifacts are encrypted when the app has an encryption key.
+	masterKey, err := deployment.LoadMasterKey(appCfg)
+	if err != nil {
+		cmd.result.AppendError(err)
+		return cmd.result
+	}
+	var dataKey []byte
+	var wrappedKey string
+	if masterKey != nil {
+		if dataKey, wrappedKey, err = getDataKey(stg, cmd.appName, masterKey); err != nil {
+			cmd.result.AppendError(err)
+			return cmd.result
+		}
+	}
+
 	// Retrieve the repository index.
 	if ri, err := getRepoIndex(stg, cmd.appName); err == nil {
 
+		// A delta requires a base whose artifact the daemons can verify once rebuilt.
+		var baseVers *repo.Version
+		if cmd.baseVersion != "" {
+			if baseVers, err = ri.GetVersion(cmd.baseVersion); err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+			if dataKey != nil {
+				cmd.result.Errorf("deltas are not supported for encrypted applications")
+				return cmd.result
+			}
+			if baseVers.Digest == "" {
+				cmd.result.Errorf("base version %q was uploaded before content digests, so cannot be a base", cmd.baseVersion)
+				return cmd.result
+			}
+		}
+
 		// Open the artifact to be uploaded.
 		if fh, err := os.Open(cmd.filename); err == nil {
 			defer fh.Close()
@@ -97,40 +155,90 @@ func (cmd *Upload) Exec() *Result {
 				return cmd.result
 			}
 
-			// Write the artifact to the repo.
-			repoFilename := ri.ArtifactFilename(cmd.appVersion, extension)
-			repoPath := ri.ArtifactPath(repoFilename)
-			if err := stg.PutReader(repoPath, fh, fi.Size()); err != nil {
+			// Determine the digest of the artifact, which names its blob.
+			digest, err := fileDigest(fh)
+			if err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+			newVers := repo.Version{
+				Filename:  ri.ArtifactFilename(cmd.appVersion, extension),
+				Encrypted: dataKey != nil,
+				Digest:    digest,
+				Size:      fi.Size(),
+			}
+			repoPath := ri.VersionPath(&newVers)
+			hmacPath := ri.VersionHMACPath(&newVers)
+
+			// Identical content need not be uploaded again.
+			artifactExists, _ := stg.Exists(repoPath)
+			hmacExists, _ := stg.Exists(hmacPath)
+			if artifactExists && hmacExists {
+				fmt.Printf("Artifact already present as %q; skipping upload\n", repoPath)
+			} else if err := cmd.putArtifact(stg, fh, fi.Size(), dataKey, appCfg.Secret, repoPath, hmacPath); err != nil {
 				cmd.result.AppendError(err)
 				return cmd.result
 			}
 
-			// Calculate the artifact HMAC and write that to the repo.
-			if fh, err := os.Open(cmd.filename); err == nil {
-				hmac := deployment.CalculateHMAC(fh, deployment.NewHMACCalculator(appCfg.Secret))
-				hmacPath := ri.HMACPath(repoFilename)
-				if err := stg.Put(hmacPath, hmac); err != nil {
+			// Store the delta against the base version, if requested.
+			if baseVers != nil {
+				newVers.Delta = &repo.Delta{Base: baseVers.Name, BaseDigest: baseVers.Digest}
+				if err := cmd.putDelta(stg, ri, &newVers, baseVers, fh, fi.Size()); err != nil {
 					cmd.result.AppendError(err)
 					return cmd.result
 				}
-			} else {
+			}
+
+			// Serialize the index update with other users of the repository, re-reading
+			// the index, which may have changed during the upload.
+			unlock, err := lockRepoIndex(stg, cmd.appName)
+			if err != nil {
 				cmd.result.AppendError(err)
 				return cmd.result
 			}
+			defer unlock()
+			if ri, err = getRepoIndex(stg, cmd.appName); err != nil {
+				cmd.result.AppendError(err)
+				return cmd.result
+			}
+			if dataKey != nil && ri.DataKey != wrappedKey {
+				cmd.result.Errorf("the data key for %q changed during the upload; upload again", cmd.appName)
+				return cmd.result
+			}
 
-			// This callback will be called for each entry purged from the repository.
-			onDelete := func(versionName string) {
-				if vers, err := ri.GetVersion(versionName); err == nil {
-					stg.Delete(ri.ArtifactPath(vers.Filename))
-					stg.Delete(ri.HMACPath(vers.Filename))
+			// The files must still be present, as "fsck -repair" deletes those that no
+			// version refers to, and could have run before the index was locked.
+			written := []string{repoPath, hmacPath}
+			if newVers.Delta != nil {
+				written = append(written, ri.DeltaPath(&newVers))
+			}
+			for _, p := range written {
+				if exists, err := stg.Exists(p); err != nil {
+					cmd.result.AppendError(err)
+					return cmd.result
+				} else if !exists {
+					cmd.result.Errorf("%q was removed during the upload; upload again", p)
+					return cmd.result
 				}
 			}
 
+			// This callback will be called for each entry purged from the repository;
+			// blobs still in use, including by the new version, are kept.
+			onDelete := func(versionName string) {
+				deleteVersionFiles(stg, ri, versionName, newVers.BlobName())
+			}
+
 			// Update the index.
-			if err := ri.AddVersion(cmd.appVersion, repoFilename, !cmd.disabled, onDelete); err != nil {
+			if err := ri.AddVersion(cmd.appVersion, newVers.Filename, !cmd.disabled, onDelete); err != nil {
 				cmd.result.AppendError(err)
 				return cmd.result
 			}
+			if vers, err := ri.GetVersion(cmd.appVersion); err == nil {
+				vers.Encrypted = newVers.Encrypted
+				vers.Digest = newVers.Digest
+				vers.Size = newVers.Size
+				vers.Delta = newVers.Delta
+			}
 
 			// Write the index back.
 			if err := setRepoIndex(stg, ri); err != nil {
@@ -146,3 +254,119 @@ func (cmd *Upload) Exec() *Result {
 
 	return cmd.result
 }
+
+// putArtifact writes the artifact to the repo, encrypting it if required, and
+// calculating its HMAC as it goes; the HMAC of an encrypted artifact covers the
+// ciphertext.
+func (cmd *Upload) putArtifact(stg storage.Storage, fh io.Reader, size int64, dataKey []byte,
+	secret, repoPath, hmacPath string) error {
+
+	var artifact io.Reader = fh
+	length := size
+	if dataKey != nil {
+		var err error
+		if artifact, err = deployment.NewEncrypter(fh, dataKey); err != nil {
+			return err
+		}
+		length = deployment.EncryptedLength(size)
+	}
+
+	hw := deployment.NewHMACWriter(deployment.NewHMACCalculator(secret))
+	if err := stg.PutMultipart(repoPath, io.TeeReader(artifact, hw), length, cmd.partSize); err != nil {
+		return err
+	}
+
+	return stg.Put(hmacPath, hw.Sum())
+}
+
+// putDelta writes a delta that rebuilds the new version's artifact from that of the
+// base version, unless an identical delta is already present.
+func (cmd *Upload) putDelta(stg storage.Storage, ri *repo.Index, newVers, baseVers *repo.Version,
+	fh *os.File, size int64) error {
+
+	deltaPath := ri.DeltaPath(newVers)
+	if exists, _ := stg.Exists(deltaPath); exists {
+		fmt.Printf("Delta already present as %q; skipping upload\n", deltaPath)
+		return nil
+	}
+
+	// Build the delta in a temporary file, comparing the artifact with the stored base.
+	base, err := stg.GetReader(ri.VersionPath(baseVers))
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	if _, err := fh.Seek(0, 0); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile("", "pulldeploy-delta")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := deployment.MakeDelta(base, fh, tmp); err != nil {
+		return err
+	}
+	deltaSize, err := tmp.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	if err := stg.PutMultipart(deltaPath, tmp, deltaSize, cmd.partSize); err != nil {
+		return err
+	}
+	fmt.Printf("Delta from %q: %d bytes (%d%% of %d)\n", baseVers.Name, deltaSize, deltaSize*100/(size+1), size)
+	return nil
+}
+
+// fileDigest returns the hex SHA-256 of a file, leaving it positioned at the start.
+func fileDigest(fh *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fh); err != nil {
+		return "", err
+	}
+	if _, err := fh.Seek(0, 0); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// getDataKey returns the app's data key, both plain and wrapped, creating and
+// storing it in the index if this is the first encrypted upload.
+func getDataKey(stg storage.Storage, appName string, masterKey []byte) ([]byte, string, error) {
+
+	unlock, err := lockRepoIndex(stg, appName)
+	if err != nil {
+		return nil, "", err
+	}
+	defer unlock()
+
+	ri, err := getRepoIndex(stg, appName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Use the existing key, if there is one.
+	if ri.DataKey != "" {
+		dataKey, err := deployment.UnwrapDataKey(masterKey, ri.DataKey)
+		return dataKey, ri.DataKey, err
+	}
+
+	// Otherwise create one, and record it before it is used.
+	dataKey, err := deployment.GenerateDataKey()
+	if err != nil {
+		return nil, "", err
+	}
+	if ri.DataKey, err = deployment.WrapDataKey(masterKey, dataKey); err != nil {
+		return nil, "", err
+	}
+	if err := setRepoIndex(stg, ri); err != nil {
+		return nil, "", err
+	}
+
+	return dataKey, ri.DataKey, nil
+}
@@ -0,0 +1,155 @@
+package deployment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Cache holds verified artifacts on the application host, so that an artifact
+need not be fetched from the repository again, whether for another application
+or environment that uses the same content, or after a restart.
+
+Cached artifacts are named by the SHA-256 digest of their content, which is
+checked before an artifact is added. Every use of an artifact refreshes its
+modification time, and when the cache exceeds its size limit the least recently
+used artifacts are evicted. Encrypted artifacts are not cached, so that their
+plaintext is never shared with other applications.
+*/
+type Cache struct {
+	dir     string     // The directory holding the cached artifacts
+	maxSize int64      // The total size in bytes beyond which artifacts are evicted
+	mu      sync.Mutex // Serializes eviction within this process
+}
+
+// NewCache returns a Cache in the given directory, creating it if necessary.
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("Cache initialization error: directory is mandatory")
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("Cache initialization error: size limit must be positive")
+	}
+	dir = absPath(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Cache initialization error: %s", err.Error())
+	}
+	return &Cache{dir: dir, maxSize: maxSize}, nil
+}
+
+// Open returns a stream for reading a cached artifact, marking it as recently used.
+func (c *Cache) Open(digest string) (io.ReadCloser, error) {
+	cachePath, err := c.path(digest)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(cachePath, now, now)
+	return fp, nil
+}
+
+// Add copies an artifact into the cache, provided that its content matches the
+// digest, then evicts artifacts as needed to respect the size limit.
+func (c *Cache) Add(digest string, r io.Reader) error {
+
+	cachePath, err := c.path(digest)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file, which is renamed into place only once verified.
+	fp, err := ioutil.TempFile(c.dir, "."+digest+".tmp")
+	if err != nil {
+		return fmt.Errorf("Error while creating temporary file: %s", err.Error())
+	}
+	defer os.Remove(fp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(fp, io.TeeReader(r, hash))
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error while caching %q: %s", digest, err.Error())
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return fmt.Errorf("Artifact does not match its digest: expected %q, calculated %q", digest, actual)
+	}
+	if err := os.Rename(fp.Name(), cachePath); err != nil {
+		return fmt.Errorf("Error while caching %q: %s", digest, err.Error())
+	}
+
+	c.evict(digest)
+	return nil
+}
+
+// Remove deletes an artifact from the cache, for example when it fails verification.
+func (c *Cache) Remove(digest string) {
+	if cachePath, err := c.path(digest); err == nil {
+		os.Remove(cachePath)
+	}
+}
+
+// Utility helper to generate the path of a cached artifact, refusing digests
+// that could name a file outside the cache.
+func (c *Cache) path(digest string) (string, error) {
+	if digest == "" || strings.ContainsAny(digest, "/.") {
+		return "", fmt.Errorf("Invalid artifact digest %q", digest)
+	}
+	return path.Join(c.dir, digest), nil
+}
+
+// evict removes the least recently used artifacts until the cache fits its
+// size limit; the artifact named by keep is never evicted.
+func (c *Cache) evict(keep string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fi, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	// Work files of other writers are neither counted nor evicted.
+	var entries []os.FileInfo
+	var total int64
+	for _, f := range fi {
+		if f.Mode().IsRegular() && !strings.HasPrefix(f.Name(), ".") {
+			entries = append(entries, f)
+			total += f.Size()
+		}
+	}
+
+	sort.Sort(byModTime(entries))
+	for _, f := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if f.Name() == keep {
+			continue
+		}
+		if err := os.Remove(path.Join(c.dir, f.Name())); err == nil {
+			total -= f.Size()
+		}
+	}
+}
+
+// A sorter for ordering files from least to most recently used.
+type byModTime []os.FileInfo
+
+func (fi byModTime) Len() int           { return len(fi) }
+func (fi byModTime) Swap(i, j int)      { fi[i], fi[j] = fi[j], fi[i] }
+func (fi byModTime) Less(i, j int) bool { return fi[i].ModTime().Before(fi[j].ModTime()) }
@@ -0,0 +1,249 @@
+package deployment
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mredivo/pulldeploy/pdconfig"
+)
+
+/*
+Artifacts are encrypted with envelope encryption: each application has its own
+randomly generated data key, which encrypts the artifacts, and which is itself
+stored in the repository index wrapped (encrypted) by a master key that only
+appears in the application configuration.
+
+An encrypted artifact is a header, made up of a magic number and a random nonce
+prefix, followed by a series of AES-256-GCM sealed chunks of kCRYPT_CHUNK_SIZE
+bytes of plaintext; the last chunk may be shorter. Each chunk's nonce is the
+prefix followed by the chunk number, and the last chunk is sealed with distinct
+additional data, so that reordered, truncated or extended artifacts fail to
+decrypt.
+*/
+const kCRYPT_MAGIC = "PDE1"
+const kCRYPT_PREFIX_SIZE = 8
+const kCRYPT_HEADER_SIZE = len(kCRYPT_MAGIC) + kCRYPT_PREFIX_SIZE
+const kCRYPT_CHUNK_SIZE = 64 * 1024
+const kCRYPT_OVERHEAD = 16 // The bytes AES-GCM adds to each sealed chunk
+const kCRYPT_KEY_SIZE = 32
+const kCRYPT_WRAP_AD = "pulldeploy-datakey"
+
+// LoadMasterKey returns the key configured to wrap the application's data key,
+// or nil if the application does not use encryption.
+func LoadMasterKey(cfg *pdconfig.AppConfig) ([]byte, error) {
+
+	encoded := cfg.EncryptionKey
+	if cfg.EncryptionKeyFile != "" {
+		if encoded != "" {
+			return nil, errors.New("Only one of encryptionkey and encryptionkeyfile may be given")
+		}
+		text, err := ioutil.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read encryption key: %s", err.Error())
+		}
+		encoded = string(text)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	// The key is base64 encoded, for example from "head -c 32 /dev/urandom | base64".
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != kCRYPT_KEY_SIZE {
+		return nil, fmt.Errorf("Encryption key must be %d bytes, base64 encoded", kCRYPT_KEY_SIZE)
+	}
+
+	return key, nil
+}
+
+// GenerateDataKey returns a new random data key.
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, kCRYPT_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapDataKey encrypts a data key with the master key, for storage in the index.
+func WrapDataKey(masterKey, dataKey []byte) (string, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(kCRYPT_WRAP_AD))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// UnwrapDataKey decrypts a data key wrapped by WrapDataKey.
+func UnwrapDataKey(masterKey []byte, wrappedKey string) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Invalid wrapped data key")
+	}
+	dataKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(kCRYPT_WRAP_AD))
+	if err != nil {
+		return nil, errors.New("Unable to unwrap data key: wrong encryption key?")
+	}
+	return dataKey, nil
+}
+
+// EncryptedLength returns the length of the encrypted form of plainLength bytes.
+func EncryptedLength(plainLength int64) int64 {
+	chunks := (plainLength + kCRYPT_CHUNK_SIZE - 1) / kCRYPT_CHUNK_SIZE
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(kCRYPT_HEADER_SIZE) + plainLength + chunks*int64(kCRYPT_OVERHEAD)
+}
+
+// NewEncrypter returns a stream of the encrypted form of the given plaintext.
+func NewEncrypter(r io.Reader, dataKey []byte) (io.Reader, error) {
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, kCRYPT_PREFIX_SIZE)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(kCRYPT_MAGIC), prefix...)
+	return &cryptStream{
+		chunks: newChunker(r, kCRYPT_CHUNK_SIZE),
+		aead:   aead,
+		prefix: prefix,
+		out:    header,
+		seal:   true,
+	}, nil
+}
+
+// NewDecrypter returns a stream of the plaintext of the given encrypted stream.
+func NewDecrypter(r io.Reader, dataKey []byte) (io.Reader, error) {
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, kCRYPT_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(kCRYPT_MAGIC)]) != kCRYPT_MAGIC {
+		return nil, errors.New("Not an encrypted artifact")
+	}
+
+	return &cryptStream{
+		chunks: newChunker(r, kCRYPT_CHUNK_SIZE+kCRYPT_OVERHEAD),
+		aead:   aead,
+		prefix: header[len(kCRYPT_MAGIC):],
+		seal:   false,
+	}, nil
+}
+
+// cryptStream seals or opens a stream one chunk at a time.
+type cryptStream struct {
+	chunks  *chunker
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+	seal    bool
+	done    bool
+}
+
+func (cs *cryptStream) Read(p []byte) (int, error) {
+
+	for len(cs.out) == 0 {
+		if cs.done {
+			return 0, io.EOF
+		}
+		chunk, final, err := cs.chunks.next()
+		if err != nil {
+			return 0, err
+		}
+
+		// The final chunk is marked, so that truncation is detected.
+		nonce := make([]byte, cs.aead.NonceSize())
+		copy(nonce, cs.prefix)
+		binary.BigEndian.PutUint32(nonce[kCRYPT_PREFIX_SIZE:], cs.counter)
+		ad := []byte{0}
+		if final {
+			ad[0] = 1
+		}
+		cs.counter++
+		cs.done = final
+
+		if cs.seal {
+			cs.out = cs.aead.Seal(cs.buf[:0], nonce, chunk, ad)
+		} else if cs.out, err = cs.aead.Open(cs.buf[:0], nonce, chunk, ad); err != nil {
+			return 0, errors.New("Decryption failed: artifact is corrupt, or the key is wrong")
+		}
+		cs.buf = cs.out
+	}
+
+	n := copy(p, cs.out)
+	cs.out = cs.out[n:]
+	return n, nil
+}
+
+// chunker reads a stream in fixed-size chunks, reading one chunk ahead so
+// that it can tell when a chunk is the last.
+type chunker struct {
+	r       io.Reader
+	bufs    [2][]byte
+	which   int
+	n       int
+	err     error
+	started bool
+}
+
+func newChunker(r io.Reader, size int) *chunker {
+	return &chunker{r: r, bufs: [2][]byte{make([]byte, size), make([]byte, size)}}
+}
+
+// next returns the next chunk, which remains valid until the following call.
+func (c *chunker) next() ([]byte, bool, error) {
+
+	if !c.started {
+		c.n, c.err = io.ReadFull(c.r, c.bufs[c.which])
+		c.started = true
+	}
+	if c.err != nil && c.err != io.EOF && c.err != io.ErrUnexpectedEOF {
+		return nil, false, c.err
+	}
+
+	// A short chunk is the last one.
+	chunk := c.bufs[c.which][:c.n]
+	if c.err != nil {
+		return chunk, true, nil
+	}
+
+	// A full chunk is the last one only if nothing follows it.
+	c.which = 1 - c.which
+	c.n, c.err = io.ReadFull(c.r, c.bufs[c.which])
+	return chunk, c.err == io.EOF, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
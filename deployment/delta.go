@@ -0,0 +1,264 @@
+package deployment
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+A delta describes an artifact in terms of an earlier artifact, its base, so that
+a host that already holds the base need fetch only what has changed.
+
+The base is divided into blocks of kDELTA_BLOCK_SIZE bytes, which are found in
+the new artifact wherever they occur, at any offset, using a rolling checksum
+confirmed by SHA-256. The delta is a header followed by a series of operations:
+copy a range of the base, or insert literal data; the last operation marks the
+end. Nothing in the delta is trusted: the rebuilt artifact must match the HMAC
+and digest of the new version before it is used.
+*/
+const kDELTA_MAGIC = "PDD1"
+const kDELTA_BLOCK_SIZE = 8192
+const kDELTA_BUF_SIZE = 8 * kDELTA_BLOCK_SIZE
+const kDELTA_MAX_LITERAL = 65536
+
+// The operations that make up a delta.
+const (
+	kDELTA_OP_COPY byte = 'C' // Followed by the offset (8 bytes) and length (4 bytes) of a range of the base
+	kDELTA_OP_DATA byte = 'D' // Followed by a length (4 bytes) and that many bytes of literal data
+	kDELTA_OP_END  byte = 'E' // Marks the end of the delta
+)
+
+// deltaBlock identifies a block of the base.
+type deltaBlock struct {
+	strong [sha256.Size]byte
+	offset int64
+}
+
+// MakeDelta writes a delta that rebuilds target from base, both read once in order.
+func MakeDelta(base, target io.Reader, w io.Writer) error {
+
+	// Index the full blocks of the base by their weak checksum.
+	index := make(map[uint32][]deltaBlock)
+	block := make([]byte, kDELTA_BLOCK_SIZE)
+	for offset := int64(0); ; offset += kDELTA_BLOCK_SIZE {
+		n, err := io.ReadFull(base, block)
+		if n == kDELTA_BLOCK_SIZE {
+			weak := weakChecksum(block)
+			index[weak] = append(index[weak], deltaBlock{sha256.Sum256(block), offset})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error while reading base artifact: %s", err.Error())
+		}
+	}
+
+	dw := &deltaWriter{w: bufio.NewWriter(w)}
+	if _, err := dw.w.WriteString(kDELTA_MAGIC); err != nil {
+		return err
+	}
+
+	// The target is scanned through a buffer holding the pending literal data,
+	// buf[lit:pos], followed by the window being matched, buf[pos:pos+blocksize].
+	buf := make([]byte, kDELTA_BUF_SIZE)
+	var lit, pos, end int
+	var eof bool
+	fill := func() error {
+		for end-pos <= kDELTA_BLOCK_SIZE && !eof {
+			if end == len(buf) {
+				if err := dw.data(buf[lit:pos]); err != nil {
+					return err
+				}
+				end = copy(buf, buf[pos:end])
+				lit, pos = 0, 0
+			}
+			n, err := target.Read(buf[end:])
+			end += n
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("Error while reading artifact: %s", err.Error())
+			}
+		}
+		return nil
+	}
+
+	var a, b uint32
+	rolling := false
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		if end-pos < kDELTA_BLOCK_SIZE {
+			break
+		}
+		if !rolling {
+			a, b = weakSums(buf[pos : pos+kDELTA_BLOCK_SIZE])
+			rolling = true
+		}
+
+		// Copy a matching block from the base.
+		if candidates, found := index[a|b<<16]; found {
+			strong := sha256.Sum256(buf[pos : pos+kDELTA_BLOCK_SIZE])
+			if offset, matched := matchBlock(candidates, strong); matched {
+				if err := dw.data(buf[lit:pos]); err != nil {
+					return err
+				}
+				if err := dw.copy(offset, kDELTA_BLOCK_SIZE); err != nil {
+					return err
+				}
+				pos += kDELTA_BLOCK_SIZE
+				lit = pos
+				rolling = false
+				continue
+			}
+		}
+
+		// Otherwise slide the window on by a byte, which becomes literal data.
+		if end-pos == kDELTA_BLOCK_SIZE {
+			break
+		}
+		out, in := uint32(buf[pos]), uint32(buf[pos+kDELTA_BLOCK_SIZE])
+		a = (a - out + in) & 0xffff
+		b = (b - kDELTA_BLOCK_SIZE*out + a) & 0xffff
+		pos++
+		if pos-lit >= kDELTA_MAX_LITERAL {
+			if err := dw.data(buf[lit:pos]); err != nil {
+				return err
+			}
+			lit = pos
+		}
+	}
+
+	// Whatever remains is literal data.
+	if err := dw.data(buf[lit:end]); err != nil {
+		return err
+	}
+	return dw.end()
+}
+
+// ApplyDelta writes the artifact rebuilt from a base and a delta.
+func ApplyDelta(base io.ReaderAt, delta io.Reader, w io.Writer) error {
+
+	r := bufio.NewReader(delta)
+	magic := make([]byte, len(kDELTA_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != kDELTA_MAGIC {
+		return errors.New("Not a delta")
+	}
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("Delta is truncated: %s", err.Error())
+		}
+		switch op {
+		case kDELTA_OP_COPY:
+			var hdr struct {
+				Offset int64
+				Length uint32
+			}
+			if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+				return fmt.Errorf("Delta is truncated: %s", err.Error())
+			}
+			section := io.NewSectionReader(base, hdr.Offset, int64(hdr.Length))
+			if n, err := io.Copy(w, section); err != nil {
+				return err
+			} else if n != int64(hdr.Length) {
+				return errors.New("Delta does not match its base")
+			}
+		case kDELTA_OP_DATA:
+			var length uint32
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				return fmt.Errorf("Delta is truncated: %s", err.Error())
+			}
+			if _, err := io.CopyN(w, r, int64(length)); err != nil {
+				return fmt.Errorf("Delta is truncated: %s", err.Error())
+			}
+		case kDELTA_OP_END:
+			return nil
+		default:
+			return fmt.Errorf("Delta is corrupt: unknown operation %q", op)
+		}
+	}
+}
+
+// deltaWriter writes delta operations, merging copies of adjacent ranges.
+type deltaWriter struct {
+	w          *bufio.Writer
+	copyOffset int64
+	copyLength int64
+}
+
+func (dw *deltaWriter) copy(offset, length int64) error {
+	if dw.copyLength > 0 && dw.copyOffset+dw.copyLength == offset && dw.copyLength+length <= 1<<31 {
+		dw.copyLength += length
+		return nil
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.copyOffset, dw.copyLength = offset, length
+	return nil
+}
+
+func (dw *deltaWriter) data(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.w.WriteByte(kDELTA_OP_DATA)
+	binary.Write(dw.w, binary.BigEndian, uint32(len(p)))
+	_, err := dw.w.Write(p)
+	return err
+}
+
+func (dw *deltaWriter) end() error {
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.w.WriteByte(kDELTA_OP_END)
+	return dw.w.Flush()
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyLength == 0 {
+		return nil
+	}
+	dw.w.WriteByte(kDELTA_OP_COPY)
+	binary.Write(dw.w, binary.BigEndian, dw.copyOffset)
+	err := binary.Write(dw.w, binary.BigEndian, uint32(dw.copyLength))
+	dw.copyLength = 0
+	return err
+}
+
+// matchBlock finds the base block with the given strong checksum.
+func matchBlock(candidates []deltaBlock, strong [sha256.Size]byte) (int64, bool) {
+	for _, candidate := range candidates {
+		if candidate.strong == strong {
+			return candidate.offset, true
+		}
+	}
+	return 0, false
+}
+
+// weakSums returns the two halves of the rolling checksum of a block.
+func weakSums(block []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// weakChecksum returns the rolling checksum of a block.
+func weakChecksum(block []byte) uint32 {
+	a, b := weakSums(block)
+	return a | b<<16
+}
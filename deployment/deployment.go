@@ -6,12 +6,21 @@ directory structure:
 
 	/BASEDIR/APPNAME/artifact
 	/BASEDIR/APPNAME/current  (a symlink)
+	/BASEDIR/APPNAME/journal  (the stage each version has reached)
+	/BASEDIR/APPNAME/lock     (held by the daemon while it changes the deployment)
+	/BASEDIR/APPNAME/previous (the version released before the current one)
 	/BASEDIR/APPNAME/release
+	/BASEDIR/APPNAME/shared   (if configured)
 
 Artifacts retrieved from the repository are placed into the "artifact" directory:
 
 	/BASEDIR/APPNAME/artifact/APPNAME-VERSION.ARTIFACTTYPE
 
+Artifacts are written under a temporary name, and renamed into place only once
+complete and verified, so that an interrupted fetch never leaves behind a file
+that appears to be present. Verified artifacts may also be kept in a Cache
+shared by all deployments on the host.
+
 Deployed releases are unpacked into a directory named for the version, under the
 "release" directory.
 
@@ -19,13 +28,27 @@ Deployed releases are unpacked into a directory named for the version, under the
 	/BASEDIR/APPNAME/release/VERSION2
 	/BASEDIR/APPNAME/release/VERSION3
 
+A version is deployed only once the journal records it as ready, which is after
+it has been verified, extracted, and its post-deploy command run.
+
 Releasing a version points the "current" symlink to the specified release directory.
 
+Directories that must persist from one release to the next, such as for logs, are
+kept under the "shared" directory, and linked into each release directory:
+
+	/BASEDIR/APPNAME/release/VERSION1/log -> /BASEDIR/APPNAME/shared/log
+
+An application may configure scripts to run at each phase of this process, such
+as after a version is extracted, or before it is released; a failing script run
+before a step prevents that step.
+
 */
 package deployment
 
 import (
 	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +58,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/mredivo/pulldeploy/pdconfig"
 )
@@ -42,6 +66,8 @@ import (
 const kARTIFACTDIR = "artifact"
 const kRELEASEDIR = "release"
 const kCURRENTDIR = "current"
+const kSHAREDDIR = "shared"
+const kPREVIOUSFILE = "previous"
 const kHMACSUFFIX = "hmac"
 
 // Deployment provides methods for manipulating local deployment files.
@@ -54,6 +80,9 @@ type Deployment struct {
 	baseDir     string                  // The derived top-level directory for this app's files
 	artifactDir string                  // The derived subdirectory for fetched build artifacts
 	releaseDir  string                  // The derived subdirectory for extracted build artifacts
+	cache       *Cache                  // The optional cache of verified artifacts shared with other deployments
+	envName     string                  // The environment being tracked, if known
+	lock        *os.File                // The lock file, while the lock is held
 }
 
 // New returns a new Deployment.
@@ -80,9 +109,8 @@ func New(appName string, pdcfg pdconfig.PDConfig, cfg *pdconfig.AppConfig) (*Dep
 		return nil, fmt.Errorf("Deployment initialization error: invalid ArtifactType %q", d.cfg.ArtifactType)
 	}
 
-	// Derive the UID/GID from the username/groupname.
-	// NOTE: Go doesn't yet support looking up a GID from a name, so
-	//       we use the gid from the user.
+	// Derive the UID/GID from the username/groupname; without a group,
+	// the gid of the user is used.
 	if d.cfg.User != "" {
 		if user, err := user.Lookup(d.cfg.User); err == nil {
 			if i, err := strconv.ParseInt(user.Uid, 10, 64); err == nil {
@@ -93,6 +121,13 @@ func New(appName string, pdcfg pdconfig.PDConfig, cfg *pdconfig.AppConfig) (*Dep
 			}
 		}
 	}
+	if d.cfg.Group != "" {
+		if group, err := user.LookupGroup(d.cfg.Group); err == nil {
+			if i, err := strconv.ParseInt(group.Gid, 10, 64); err == nil {
+				d.gid = int(i)
+			}
+		}
+	}
 
 	// The parent directory must not be "/".
 	parentDir := absPath(d.cfg.BaseDir)
@@ -140,29 +175,232 @@ func (d *Deployment) ArtifactPresent(version string) bool {
 	return exists
 }
 
+// SetCache arranges for verified artifacts to be shared through the given cache.
+func (d *Deployment) SetCache(cache *Cache) {
+	d.cache = cache
+}
+
+// SetEnv records the environment being tracked, for the commands run during deployment.
+func (d *Deployment) SetEnv(envName string) {
+	d.envName = envName
+}
+
+// OpenArtifact opens an artifact in the artifact area for reading.
+func (d *Deployment) OpenArtifact(version string) (*os.File, error) {
+	artifactPath, exists := makeArtifactPath(d.artifactDir, d.appName, version, d.acfg.Extension)
+	if !exists {
+		return nil, fmt.Errorf("Artifact does not exist: %s", artifactPath)
+	}
+	return os.Open(artifactPath)
+}
+
 // Write creates a file in the artifact area from the given stream.
 func (d *Deployment) WriteArtifact(version string, rc io.ReadCloser) error {
 
 	// Housekeeping: ensure the source is closed when done.
 	defer rc.Close()
 
+	return d.writeArtifact(version, rc, nil, "")
+}
+
+/*
+WriteVerifiedArtifact creates a file in the artifact area from the given stream,
+along with its HMAC, but only if the stream matches the expected HMAC and, if one
+is given, the digest of its content. Nothing is left in the artifact area if the
+stream is interrupted or fails verification.
+
+A verified artifact that has a digest is also added to the cache, if any.
+*/
+func (d *Deployment) WriteVerifiedArtifact(version string, rc io.ReadCloser, expectedMAC []byte, digest string) error {
+
+	// Housekeeping: ensure the source is closed when done.
+	defer rc.Close()
+
+	if err := d.writeArtifact(version, rc, expectedMAC, digest); err != nil {
+		return err
+	}
+	if err := d.WriteHMAC(version, expectedMAC); err != nil {
+		return err
+	}
+
+	// Caching is an optimization, so failure to cache is not an error.
+	if d.cache != nil && digest != "" {
+		artifactPath, _ := makeArtifactPath(d.artifactDir, d.appName, version, d.acfg.Extension)
+		if fp, err := os.Open(artifactPath); err == nil {
+			d.cache.Add(digest, fp)
+			fp.Close()
+		}
+	}
+
+	return nil
+}
+
+/*
+WriteCachedArtifact creates a file in the artifact area from the cache, along
+with its HMAC, subject to the same verification as WriteVerifiedArtifact.
+
+An error is returned if there is no cache, or the artifact is not in it; a
+cached artifact that fails verification is removed from the cache.
+*/
+func (d *Deployment) WriteCachedArtifact(version string, expectedMAC []byte, digest string) error {
+
+	if d.cache == nil || digest == "" {
+		return errors.New("Artifact is not cached")
+	}
+	rc, err := d.cache.Open(digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := d.writeArtifact(version, rc, expectedMAC, digest); err != nil {
+		d.cache.Remove(digest)
+		return err
+	}
+
+	return d.WriteHMAC(version, expectedMAC)
+}
+
+/*
+WriteDeltaArtifact rebuilds an artifact from the artifact of a base version
+already in the artifact area, and a delta stream, subject to the same
+verification as WriteVerifiedArtifact; it is the rebuilt artifact that must
+match the expected HMAC and digest.
+*/
+func (d *Deployment) WriteDeltaArtifact(version, baseVersion string, rc io.ReadCloser, expectedMAC []byte, digest string) error {
+
+	// Housekeeping: ensure the source is closed when done.
+	defer rc.Close()
+
+	base, err := d.OpenArtifact(baseVersion)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	// Rebuild the artifact as it is written.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ApplyDelta(base, rc, pw))
+	}()
+	return d.WriteVerifiedArtifact(version, pr, expectedMAC, digest)
+}
+
+/*
+WriteEncryptedArtifact decrypts an encrypted artifact stream into the artifact area.
+
+The expected HMAC covers the encrypted artifact, and is checked before any
+decryption is attempted; the encrypted stream is held in a temporary file until
+then. The artifact is then decrypted via WriteArtifact, using the data key
+unwrapped with the application's master key, and the HMAC of the plaintext is
+written alongside it, for use by CheckHMAC.
+*/
+func (d *Deployment) WriteEncryptedArtifact(version string, rc io.ReadCloser, expectedMAC []byte, wrappedKey string) error {
+
+	// Housekeeping: ensure the source is closed when done.
+	defer rc.Close()
+
+	// Recover the data key.
+	masterKey, err := LoadMasterKey(&d.cfg)
+	if err != nil {
+		return err
+	}
+	if masterKey == nil {
+		return fmt.Errorf("Artifact is encrypted, but no encryption key is configured for %q", d.appName)
+	}
+	dataKey, err := UnwrapDataKey(masterKey, wrappedKey)
+	if err != nil {
+		return err
+	}
+
+	// Hold the encrypted artifact aside, calculating its HMAC as it arrives.
+	fp, err := ioutil.TempFile(d.artifactDir, "."+d.appName+"-"+version+".encrypted")
+	if err != nil {
+		return fmt.Errorf("Error while creating temporary file: %s", err.Error())
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	hw := NewHMACWriter(NewHMACCalculator(d.cfg.Secret))
+	if _, err := io.Copy(fp, io.TeeReader(rc, hw)); err != nil {
+		return fmt.Errorf("Error while creating %q: %s", fp.Name(), err.Error())
+	}
+	if messageMAC := hw.Sum(); !hmac.Equal(messageMAC, expectedMAC) {
+		return fmt.Errorf(
+			"Encrypted artifact is corrupt: Expected HMAC: %q: Calculated HMAC: %q",
+			string(expectedMAC),
+			string(messageMAC),
+		)
+	}
+
+	// Decrypt into the artifact area, signing the plaintext as it goes.
+	if _, err := fp.Seek(0, 0); err != nil {
+		return fmt.Errorf("Error while reading %q: %s", fp.Name(), err.Error())
+	}
+	plaintext, err := NewDecrypter(fp, dataKey)
+	if err != nil {
+		return err
+	}
+	hw = NewHMACWriter(NewHMACCalculator(d.cfg.Secret))
+	if err := d.WriteArtifact(version, ioutil.NopCloser(io.TeeReader(plaintext, hw))); err != nil {
+		return err
+	}
+
+	return d.WriteHMAC(version, hw.Sum())
+}
+
+// writeArtifact writes an artifact to a temporary file, and renames it into
+// place only once it is complete, and has been checked against the expected
+// HMAC and digest, where given.
+func (d *Deployment) writeArtifact(version string, r io.Reader, expectedMAC []byte, digest string) error {
+
 	// Generate the filename, and check whether file already exists.
 	artifactPath, exists := makeArtifactPath(d.artifactDir, d.appName, version, d.acfg.Extension)
 	if exists {
 		return fmt.Errorf("Artifact already exists: %s", artifactPath)
 	}
 
-	// Open the file, and write the data into it.
-	if fp, err := os.OpenFile(artifactPath, os.O_WRONLY|os.O_CREATE, 0664); err == nil {
-		defer fp.Close()
-		if _, err := io.Copy(fp, rc); err != nil {
-			return fmt.Errorf("Error while creating %q: %s", artifactPath, err.Error())
+	// Write the data to a temporary file, calculating the HMAC and digest as it goes.
+	fp, err := ioutil.TempFile(d.artifactDir, "."+path.Base(artifactPath)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Error while creating temporary file: %s", err.Error())
+	}
+	defer os.Remove(fp.Name())
+	hw := NewHMACWriter(NewHMACCalculator(d.cfg.Secret))
+	hash := sha256.New()
+	_, err = io.Copy(fp, io.TeeReader(r, io.MultiWriter(hw, hash)))
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error while creating %q: %s", artifactPath, err.Error())
+	}
+
+	// Verify the content before making it available.
+	if expectedMAC != nil {
+		if messageMAC := hw.Sum(); !hmac.Equal(messageMAC, expectedMAC) {
+			return fmt.Errorf(
+				"Artifact is corrupt: Expected HMAC: %q: Calculated HMAC: %q",
+				string(expectedMAC),
+				string(messageMAC),
+			)
 		}
-		if err := setOwner(artifactPath, d.uid, d.gid); err != nil {
-			return fmt.Errorf("Unable to set owner on %q: %s", artifactPath, err.Error())
+	}
+	if digest != "" {
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != digest {
+			return fmt.Errorf("Artifact is corrupt: Expected digest: %q: Calculated digest: %q", digest, actual)
 		}
 	}
 
+	if err := os.Chmod(fp.Name(), 0664); err != nil {
+		return fmt.Errorf("Error while creating %q: %s", artifactPath, err.Error())
+	}
+	if err := setOwner(fp.Name(), d.uid, d.gid); err != nil {
+		return fmt.Errorf("Unable to set owner on %q: %s", artifactPath, err.Error())
+	}
+	if err := os.Rename(fp.Name(), artifactPath); err != nil {
+		return fmt.Errorf("Error while creating %q: %s", artifactPath, err.Error())
+	}
+
 	return nil
 }
 
@@ -242,8 +480,15 @@ func (d *Deployment) Extract(version string) error {
 			"Refusing to execute extract command from insecure \"pulldeploy.yaml\" as root")
 	}
 
-	// Create the version directory if it doesn't exist.
+	// Create the version directory if it doesn't exist; one left over from a
+	// deployment that did not complete is started afresh.
 	versionDir, exists := makeReleasePath(d.releaseDir, version)
+	if exists && d.GetStage(version) != KSTAGE_READY {
+		if err := os.RemoveAll(versionDir); err != nil {
+			return fmt.Errorf("Cannot remove incomplete release directory %q: %s", version, err.Error())
+		}
+		exists = false
+	}
 	if !exists {
 		if err := makeDir(versionDir, d.uid, d.gid, 0755); err != nil {
 			return fmt.Errorf("Cannot create release directory %q: %s", version, err.Error())
@@ -251,64 +496,76 @@ func (d *Deployment) Extract(version string) error {
 	}
 
 	// Extract the archive into the version directory.
-	cmdlineArgs := substituteVars(d.acfg.Extract.Args,
-		varValues{artifactPath: artifactPath, versionDir: versionDir})
-	_, err := sysCommand("", d.acfg.Extract.Cmd, cmdlineArgs)
+	values := d.varValues(version, d.GetCurrentLink())
+	cmdlineArgs := substituteVars(d.acfg.Extract.Args, values)
+	_, err := sysCommand("", values.substitute(d.acfg.Extract.Cmd), cmdlineArgs)
 	if err != nil {
+		os.RemoveAll(versionDir)
 		return fmt.Errorf("Cannot extract archive %q into %q: %s", artifactPath, versionDir, err.Error())
 	}
 
 	// Set the ownership of all the extracted files.
 	if err := setOwnerAll(versionDir, d.uid, d.gid); err != nil {
+		os.RemoveAll(versionDir)
 		return err
 	}
 
 	return nil
 }
 
-// Link sets the "current" symlink to point at the indicated version.
+// Link sets the "current" symlink to point at the indicated version, atomically.
 func (d *Deployment) Link(version string) error {
 	versionDir, exists := makeReleasePath(d.releaseDir, version)
 	if !exists {
 		return fmt.Errorf("Release directory does not exist: %q", versionDir)
 	}
 	symlinkPath := path.Join(d.baseDir, kCURRENTDIR)
-	os.Remove(symlinkPath)
-	return os.Symlink(versionDir, symlinkPath)
-}
+	previous := d.GetCurrentLink()
 
-// PostDeploy executes the configured PostDeploy command.
-func (d *Deployment) PostDeploy(version string) (string, error) {
-	if os.Geteuid() == 0 && d.cfg.Insecure {
-		return "", fmt.Errorf(
-			"Refusing to execute post-deploy command from insecure %q configuration as root",
-			d.appName)
+	// Make the new link under a temporary name, then rename it over the old one,
+	// so that there is never a moment without a current version.
+	tmpPath := path.Join(d.baseDir, "."+kCURRENTDIR+".tmp")
+	os.Remove(tmpPath)
+	if err := os.Symlink(versionDir, tmpPath); err != nil {
+		return err
 	}
-	if d.cfg.Scripts["postdeploy"].Cmd != "" {
-		artifactPath, _ := makeArtifactPath(d.artifactDir, d.appName, version, d.acfg.Extension)
-		versionDir, _ := makeReleasePath(d.releaseDir, version)
-		cmdlineArgs := substituteVars(d.cfg.Scripts["postdeploy"].Args,
-			varValues{artifactPath: artifactPath, versionDir: versionDir})
-		return sysCommand(versionDir, d.cfg.Scripts["postdeploy"].Cmd, cmdlineArgs)
+	if err := os.Rename(tmpPath, symlinkPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Remember the version that was replaced.
+	if previous != "" && previous != version {
+		return writeFileAtomic(path.Join(d.baseDir, kPREVIOUSFILE), []byte(previous+"\n"), 0644, d.uid, d.gid)
 	}
-	return "", nil
+	return nil
 }
 
-// PostRelease executes the configured PostRelease command.
-func (d *Deployment) PostRelease(version string) (string, error) {
-	if os.Geteuid() == 0 && d.cfg.Insecure {
-		return "", fmt.Errorf(
-			"Refusing to execute post-release command from insecure %q configuration as root",
-			d.appName)
+// GetPreviousLink returns the name of the version released before the current one,
+// as recorded locally.
+func (d *Deployment) GetPreviousLink() string {
+	if data, err := ioutil.ReadFile(path.Join(d.baseDir, kPREVIOUSFILE)); err == nil {
+		return strings.TrimSpace(string(data))
 	}
-	if d.cfg.Scripts["postrelease"].Cmd != "" {
-		artifactPath, _ := makeArtifactPath(d.artifactDir, d.appName, version, d.acfg.Extension)
-		versionDir, _ := makeReleasePath(d.releaseDir, version)
-		cmdlineArgs := substituteVars(d.cfg.Scripts["postrelease"].Args,
-			varValues{artifactPath: artifactPath, versionDir: versionDir})
-		return sysCommand(versionDir, d.cfg.Scripts["postrelease"].Cmd, cmdlineArgs)
+	return ""
+}
+
+// varValues returns the values to substitute into the commands run while deploying a version.
+func (d *Deployment) varValues(version, priorVersion string) varValues {
+	artifactPath, _ := makeArtifactPath(d.artifactDir, d.appName, version, d.acfg.Extension)
+	versionDir, _ := makeReleasePath(d.releaseDir, version)
+	hostName, _ := os.Hostname()
+	return varValues{
+		appName:      d.appName,
+		envName:      d.envName,
+		version:      version,
+		priorVersion: priorVersion,
+		hostName:     hostName,
+		baseDir:      d.baseDir,
+		currentDir:   path.Join(d.baseDir, kCURRENTDIR),
+		artifactPath: artifactPath,
+		versionDir:   versionDir,
 	}
-	return "", nil
 }
 
 // Remove deletes everything associated with the given name.
@@ -329,10 +586,12 @@ func (d *Deployment) Remove(version string) error {
 
 	// Remove the extracted files.
 	if versionDir, exists := makeReleasePath(d.releaseDir, version); exists {
-		return os.RemoveAll(versionDir)
+		if err := os.RemoveAll(versionDir); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return d.forgetStage(version)
 }
 
 // GetCurrentLink returns the name of the currently released version.
@@ -349,15 +608,32 @@ func (d *Deployment) GetCurrentLink() string {
 	return dirs[len(dirs)-1]
 }
 
+// FreeSpace returns the number of bytes available to unprivileged users on the
+// filesystem holding the deployment.
+func (d *Deployment) FreeSpace() (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(d.baseDir, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
+
 // GetDeployedVersions enumerates all the versions currently available for linking.
 func (d *Deployment) GetDeployedVersions() []string {
 
 	var versionList []string
 
-	// Everything in the release directory is an available version.
+	// Everything in the release directory that the journal records as ready is an
+	// available version.
+	journal, _, err := d.loadJournal()
+	if err != nil {
+		return versionList
+	}
 	if fi, err := ioutil.ReadDir(d.releaseDir); err == nil {
 		for _, v := range fi {
-			versionList = append(versionList, v.Name())
+			if entry, found := journal[v.Name()]; found && entry.Stage == KSTAGE_READY {
+				versionList = append(versionList, v.Name())
+			}
 		}
 	}
 
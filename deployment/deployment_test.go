@@ -1,12 +1,22 @@
 package deployment
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mredivo/pulldeploy/pdconfig"
+	"gopkg.in/yaml.v2"
 )
 
 // Provide a dummy configuration.
@@ -36,6 +46,18 @@ func (p *mypdConfig) GetAppList() map[string]*pdconfig.AppConfig {
 	return make(map[string]*pdconfig.AppConfig)
 }
 
+func (p *mypdConfig) GetSkippedFiles() []string {
+	return nil
+}
+
+func (p *mypdConfig) GetAppEnvVars(appName, envName string) (map[string]interface{}, error) {
+	return make(map[string]interface{}), nil
+}
+
+func (p *mypdConfig) GetAppEnv(appName string) string {
+	return ""
+}
+
 func (p *mypdConfig) GetLogLevel() string {
 	return "debug"
 }
@@ -50,6 +72,27 @@ func (p *mypdConfig) GetStorageConfig() *pdconfig.StorageConfig {
 	return &sc
 }
 
+func (p *mypdConfig) GetStorageConfigByMethod(accessMethod string) (*pdconfig.StorageConfig, error) {
+	var sc pdconfig.StorageConfig
+	sc.AccessMethod = accessMethod
+	return &sc, nil
+}
+
+func (p *mypdConfig) GetCacheConfig() *pdconfig.CacheConfig {
+	cc := new(pdconfig.CacheConfig)
+	return cc
+}
+
+func (p *mypdConfig) GetPeerConfig() *pdconfig.PeerConfig {
+	pc := new(pdconfig.PeerConfig)
+	return pc
+}
+
+func (p *mypdConfig) GetDiskConfig() *pdconfig.DiskConfig {
+	dc := new(pdconfig.DiskConfig)
+	return dc
+}
+
 func (p *mypdConfig) GetVersionInfo() *pdconfig.VersionInfo {
 	var versionInfo pdconfig.VersionInfo
 	return &versionInfo
@@ -60,6 +103,25 @@ func (p *mypdConfig) RefreshAppList() []error {
 	return errs
 }
 
+// newTestDeployment creates a deployment of an application, in a temporary base
+// directory removed when the test ends unless the configuration names one.
+func newTestDeployment(t *testing.T, appName string, appcfg *pdconfig.AppConfig) *Deployment {
+	t.Helper()
+	if appcfg.BaseDir == "" {
+		baseDir, err := ioutil.TempDir("", "pdtest")
+		if err != nil {
+			t.Fatalf("Error creating temporary directory: %s", err.Error())
+		}
+		t.Cleanup(func() { os.RemoveAll(baseDir) })
+		appcfg.BaseDir = baseDir
+	}
+	dep, err := New(appName, pdcfg, appcfg)
+	if err != nil {
+		t.Fatalf("New failed: %s", err.Error())
+	}
+	return dep
+}
+
 func TestDeploymentOperations(t *testing.T) {
 
 	const TESTAPP = "stubapp"
@@ -109,10 +171,7 @@ func TestDeploymentOperations(t *testing.T) {
 
 	// Create a Deployment for further testing.
 	appcfg = &pdconfig.AppConfig{Secret: secret, ArtifactType: "tar.gz", BaseDir: "../data/client"}
-	dep, err := New(TESTAPP, pdcfg, appcfg)
-	if err != nil {
-		t.Errorf("Deployment initialization failed: %s", err.Error())
-	}
+	dep := newTestDeployment(t, TESTAPP, appcfg)
 
 	// Write some bytes to an artifact.
 	if fp, err := os.Open("../data/testdata/stubapp.tar.gz"); err == nil {
@@ -167,6 +226,9 @@ func TestDeploymentOperations(t *testing.T) {
 	if current := dep.GetCurrentLink(); current != "" {
 		t.Errorf("Current link set to %q; should be empty", current)
 	}
+	if previous := dep.GetPreviousLink(); previous != "" {
+		t.Errorf("Previous link set to %q; should be empty", previous)
+	}
 
 	// Make it current.
 	if err := dep.Link("1.0.3"); err != nil {
@@ -220,6 +282,14 @@ func TestDeploymentOperations(t *testing.T) {
 		t.Errorf("Current link should be %q; found  %q", "1.0.4", current)
 	}
 
+	// The version it replaced should be remembered, and no temporary link left behind.
+	if previous := dep.GetPreviousLink(); previous != "1.0.3" {
+		t.Errorf("Previous link should be %q; found  %q", "1.0.3", previous)
+	}
+	if fi, _ := ioutil.ReadDir(dep.baseDir); len(fi) != 4 {
+		t.Errorf("Base directory should hold 4 entries; found %d", len(fi))
+	}
+
 	// Link a bogus version.
 	if err := dep.Link("9.9.9"); err == nil {
 		t.Errorf("Link non-existent version did not fail")
@@ -235,3 +305,556 @@ func TestDeploymentOperations(t *testing.T) {
 		t.Errorf("Remove previous version failed: %s", err.Error())
 	}
 }
+
+func TestHMACWriter(t *testing.T) {
+
+	// The streaming HMAC must match CalculateHMAC for partial, exact and multiple blocks.
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, size := range []int{0, 1, 100, 16384, 16385, 40000, 50000} {
+		fp, err := ioutil.TempFile("", "hmacwriter")
+		if err != nil {
+			t.Fatalf("Error creating temporary file: %s", err.Error())
+		}
+		fp.Write(data[:size])
+		fp.Seek(0, 0)
+		expected := CalculateHMAC(fp, NewHMACCalculator("secret"))
+		os.Remove(fp.Name())
+
+		// Write in uneven pieces, as a tee would.
+		hw := NewHMACWriter(NewHMACCalculator("secret"))
+		for pos := 0; pos < size; pos += 3000 {
+			end := pos + 3000
+			if end > size {
+				end = size
+			}
+			hw.Write(data[pos:end])
+		}
+		if !hmac.Equal(hw.Sum(), expected) {
+			t.Errorf("HMACWriter result differs from CalculateHMAC for %d bytes", size)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+
+	masterKey, _ := GenerateDataKey()
+	dataKey, _ := GenerateDataKey()
+
+	// The data key must survive wrapping, but only with the right master key.
+	wrappedKey, err := WrapDataKey(masterKey, dataKey)
+	if err != nil {
+		t.Fatalf("WrapDataKey failed: %s", err.Error())
+	}
+	if key, err := UnwrapDataKey(masterKey, wrappedKey); err != nil || !bytes.Equal(key, dataKey) {
+		t.Errorf("UnwrapDataKey did not recover the data key: %v", err)
+	}
+	otherKey, _ := GenerateDataKey()
+	if _, err := UnwrapDataKey(otherKey, wrappedKey); err == nil {
+		t.Errorf("UnwrapDataKey should have failed with the wrong master key")
+	}
+
+	// Round trip a range of sizes around the chunk boundaries.
+	data := make([]byte, 3*kCRYPT_CHUNK_SIZE+10)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	for _, size := range []int{0, 1, kCRYPT_CHUNK_SIZE - 1, kCRYPT_CHUNK_SIZE, kCRYPT_CHUNK_SIZE + 1, 3 * kCRYPT_CHUNK_SIZE, len(data)} {
+		enc, _ := NewEncrypter(bytes.NewReader(data[:size]), dataKey)
+		ciphertext, err := ioutil.ReadAll(enc)
+		if err != nil {
+			t.Errorf("Encryption of %d bytes failed: %s", size, err.Error())
+			continue
+		}
+		if int64(len(ciphertext)) != EncryptedLength(int64(size)) {
+			t.Errorf("EncryptedLength(%d) = %d, actual %d", size, EncryptedLength(int64(size)), len(ciphertext))
+		}
+		dec, err := NewDecrypter(bytes.NewReader(ciphertext), dataKey)
+		if err != nil {
+			t.Errorf("NewDecrypter failed for %d bytes: %s", size, err.Error())
+			continue
+		}
+		if plaintext, err := ioutil.ReadAll(dec); err != nil || !bytes.Equal(plaintext, data[:size]) {
+			t.Errorf("Decryption of %d bytes did not recover the plaintext: %v", size, err)
+		}
+	}
+
+	// Tampering, truncation at a chunk boundary, and the wrong key must all be detected.
+	enc, _ := NewEncrypter(bytes.NewReader(data), dataKey)
+	ciphertext, _ := ioutil.ReadAll(enc)
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)/2] ^= 0x01
+	truncated := ciphertext[:kCRYPT_HEADER_SIZE+2*(kCRYPT_CHUNK_SIZE+kCRYPT_OVERHEAD)]
+	for name, c := range map[string][]byte{"tampered": tampered, "truncated": truncated} {
+		dec, _ := NewDecrypter(bytes.NewReader(c), dataKey)
+		if _, err := ioutil.ReadAll(dec); err == nil {
+			t.Errorf("Decryption of %s ciphertext should have failed", name)
+		}
+	}
+	dec, _ := NewDecrypter(bytes.NewReader(ciphertext), otherKey)
+	if _, err := ioutil.ReadAll(dec); err == nil {
+		t.Errorf("Decryption with the wrong key should have failed")
+	}
+}
+
+func TestArtifactCache(t *testing.T) {
+
+	const secret = "the quick brown fox jumps over the lazy dog"
+
+	appcfg := &pdconfig.AppConfig{Secret: secret, ArtifactType: "tar.gz"}
+	dep1 := newTestDeployment(t, "app1", appcfg)
+	dep2 := newTestDeployment(t, "app2", appcfg)
+	baseDir := appcfg.BaseDir
+
+	cache, err := NewCache(baseDir+"/cache", 250)
+	if err != nil {
+		t.Fatalf("NewCache failed: %s", err.Error())
+	}
+	dep1.SetCache(cache)
+	dep2.SetCache(cache)
+
+	data := bytes.Repeat([]byte("artifact"), 10)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	goodHMAC := CalculateHMAC(ioutil.NopCloser(bytes.NewReader(data)), NewHMACCalculator(secret))
+
+	// A stream that fails verification leaves nothing behind.
+	if err := dep1.WriteVerifiedArtifact("1.0.0", ioutil.NopCloser(bytes.NewReader(data)), []byte("bad"), digest); err == nil {
+		t.Errorf("WriteVerifiedArtifact should have failed with a bad HMAC")
+	}
+	if err := dep1.WriteVerifiedArtifact("1.0.0", ioutil.NopCloser(bytes.NewReader(data[1:])), goodHMAC, digest); err == nil {
+		t.Errorf("WriteVerifiedArtifact should have failed with a truncated stream")
+	}
+	if dep1.ArtifactPresent("1.0.0") || dep1.HMACPresent("1.0.0") {
+		t.Errorf("Artifact present after failed verification")
+	}
+	if fi, _ := ioutil.ReadDir(dep1.artifactDir); len(fi) != 0 {
+		t.Errorf("Artifact area not empty after failed verification: %d file(s)", len(fi))
+	}
+	if err := dep2.WriteCachedArtifact("2.0.0", goodHMAC, digest); err == nil {
+		t.Errorf("WriteCachedArtifact should have failed before the artifact is cached")
+	}
+
+	// A verified artifact is cached, and can be used by another deployment.
+	if err := dep1.WriteVerifiedArtifact("1.0.0", ioutil.NopCloser(bytes.NewReader(data)), goodHMAC, digest); err != nil {
+		t.Errorf("WriteVerifiedArtifact failed: %s", err.Error())
+	}
+	if err := dep1.CheckHMAC("1.0.0"); err != nil {
+		t.Errorf("CheckHMAC failed after WriteVerifiedArtifact: %s", err.Error())
+	}
+	if err := dep2.WriteCachedArtifact("2.0.0", goodHMAC, digest); err != nil {
+		t.Errorf("WriteCachedArtifact failed: %s", err.Error())
+	}
+	if err := dep2.CheckHMAC("2.0.0"); err != nil {
+		t.Errorf("CheckHMAC failed after WriteCachedArtifact: %s", err.Error())
+	}
+
+	// A cached artifact that fails verification is removed from the cache.
+	if err := dep2.WriteCachedArtifact("2.0.1", []byte("bad"), digest); err == nil {
+		t.Errorf("WriteCachedArtifact should have failed with a bad HMAC")
+	}
+	if rc, err := cache.Open(digest); err == nil {
+		rc.Close()
+		t.Errorf("Cached artifact not removed after failed verification")
+	}
+
+	// Content that does not match its digest is not cached.
+	if err := cache.Add(digest, bytes.NewReader(data[1:])); err == nil {
+		t.Errorf("Cache Add should have failed with the wrong digest")
+	}
+	if err := cache.Add("../escape", bytes.NewReader(data)); err == nil {
+		t.Errorf("Cache Add should have refused an invalid digest")
+	}
+
+	// The least recently used artifacts are evicted beyond the size limit.
+	var digests []string
+	for i := 0; i < 3; i++ {
+		entry := bytes.Repeat([]byte{byte('a' + i)}, 100)
+		sum := sha256.Sum256(entry)
+		digests = append(digests, hex.EncodeToString(sum[:]))
+		if err := cache.Add(digests[i], bytes.NewReader(entry)); err != nil {
+			t.Errorf("Cache Add failed: %s", err.Error())
+		}
+		past := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(baseDir+"/cache/"+digests[i], past, past)
+		if i == 1 {
+			// Using the first entry makes the second the least recently used.
+			rc, _ := cache.Open(digests[0])
+			rc.Close()
+		}
+	}
+	for i, expected := range []bool{true, false, true} {
+		rc, err := cache.Open(digests[i])
+		if present := err == nil; present != expected {
+			t.Errorf("Cache entry %d present=%v, expected %v", i, present, expected)
+		}
+		if err == nil {
+			rc.Close()
+		}
+	}
+}
+
+func TestDelta(t *testing.T) {
+
+	const secret = "the quick brown fox jumps over the lazy dog"
+
+	// The base is long enough to span many blocks, and is not repetitive.
+	base := make([]byte, 20*kDELTA_BLOCK_SIZE+123)
+	for i := range base {
+		base[i] = byte((i * 7919) >> 8)
+	}
+
+	// The target has insertions, a deletion and a change, at unaligned offsets.
+	var target []byte
+	target = append(target, []byte("inserted at the start")...)
+	target = append(target, base[:3*kDELTA_BLOCK_SIZE+17]...)
+	target = append(target, []byte("changed")...)
+	target = append(target, base[3*kDELTA_BLOCK_SIZE+24:9*kDELTA_BLOCK_SIZE+5]...)
+	target = append(target, base[12*kDELTA_BLOCK_SIZE:]...)
+	target = append(target, []byte("appended at the end")...)
+
+	var delta bytes.Buffer
+	if err := MakeDelta(bytes.NewReader(base), bytes.NewReader(target), &delta); err != nil {
+		t.Fatalf("MakeDelta failed: %s", err.Error())
+	}
+	if delta.Len() > 4*kDELTA_BLOCK_SIZE {
+		t.Errorf("Delta is %d bytes for a %d byte target", delta.Len(), len(target))
+	}
+	var rebuilt bytes.Buffer
+	if err := ApplyDelta(bytes.NewReader(base), bytes.NewReader(delta.Bytes()), &rebuilt); err != nil {
+		t.Errorf("ApplyDelta failed: %s", err.Error())
+	} else if !bytes.Equal(rebuilt.Bytes(), target) {
+		t.Errorf("ApplyDelta rebuilt %d bytes, not the %d byte target", rebuilt.Len(), len(target))
+	}
+
+	// Unrelated and empty content round-trip too.
+	for _, other := range [][]byte{[]byte("nothing in common"), {}} {
+		var d, r bytes.Buffer
+		if err := MakeDelta(bytes.NewReader(base), bytes.NewReader(other), &d); err != nil {
+			t.Errorf("MakeDelta failed: %s", err.Error())
+		} else if err := ApplyDelta(bytes.NewReader(base), &d, &r); err != nil || !bytes.Equal(r.Bytes(), other) {
+			t.Errorf("ApplyDelta did not rebuild %q: %v", other, err)
+		}
+	}
+
+	// A damaged delta is refused.
+	if err := ApplyDelta(bytes.NewReader(base), bytes.NewReader(delta.Bytes()[:delta.Len()-1]), ioutil.Discard); err == nil {
+		t.Errorf("ApplyDelta should have failed with a truncated delta")
+	}
+	if err := ApplyDelta(bytes.NewReader(base[:kDELTA_BLOCK_SIZE]), bytes.NewReader(delta.Bytes()), ioutil.Discard); err == nil {
+		t.Errorf("ApplyDelta should have failed with the wrong base")
+	}
+
+	// A deployment rebuilds an artifact from the base it holds, and verifies it.
+	dep := newTestDeployment(t, "app", &pdconfig.AppConfig{Secret: secret, ArtifactType: "tar.gz"})
+	baseHMAC := CalculateHMAC(ioutil.NopCloser(bytes.NewReader(base)), NewHMACCalculator(secret))
+	if err := dep.WriteArtifact("1.0.0", ioutil.NopCloser(bytes.NewReader(base))); err != nil {
+		t.Fatalf("WriteArtifact failed: %s", err.Error())
+	}
+	dep.WriteHMAC("1.0.0", baseHMAC)
+
+	sum := sha256.Sum256(target)
+	digest := hex.EncodeToString(sum[:])
+	targetHMAC := CalculateHMAC(ioutil.NopCloser(bytes.NewReader(target)), NewHMACCalculator(secret))
+	corrupt := append([]byte(nil), delta.Bytes()...)
+	corrupt[len(corrupt)-2] ^= 0xff
+	if err := dep.WriteDeltaArtifact("2.0.0", "1.0.0", ioutil.NopCloser(bytes.NewReader(corrupt)), targetHMAC, digest); err == nil {
+		t.Errorf("WriteDeltaArtifact should have failed with a corrupt delta")
+	}
+	if dep.ArtifactPresent("2.0.0") {
+		t.Errorf("Artifact present after failed verification")
+	}
+	if err := dep.WriteDeltaArtifact("2.0.0", "0.9.0", ioutil.NopCloser(bytes.NewReader(delta.Bytes())), targetHMAC, digest); err == nil {
+		t.Errorf("WriteDeltaArtifact should have failed without its base")
+	}
+	if err := dep.WriteDeltaArtifact("2.0.0", "1.0.0", ioutil.NopCloser(bytes.NewReader(delta.Bytes())), targetHMAC, digest); err != nil {
+		t.Errorf("WriteDeltaArtifact failed: %s", err.Error())
+	}
+	if err := dep.CheckHMAC("2.0.0"); err != nil {
+		t.Errorf("CheckHMAC failed after WriteDeltaArtifact: %s", err.Error())
+	}
+}
+
+func TestRunHook(t *testing.T) {
+
+	var appcfg pdconfig.AppConfig
+	if err := yaml.Unmarshal([]byte(`
+scripts:
+    predeploy:
+        cmd: "/bin/sh"
+        args: [ "-c", "echo vetoed >&2; exit 3" ]
+    postdeploy:
+        cmd: "/bin/sh"
+        args: [ "-c", "echo warning >&2; echo $PULLDEPLOY_APP $PULLDEPLOY_ENV $PULLDEPLOY_VERSION $PULLDEPLOY_PREVIOUS_VERSION; echo leaked=$PULLDEPLOY_TEST_LEAK; printf $PULLDEPLOY_VERSION_DIGEST" ]
+    prerelease:
+        cmd: "/bin/sh"
+        args: [ "-c", "sleep 10 & sleep 10" ]
+        timeout: 1
+`), &appcfg); err != nil {
+		t.Fatalf("Error decoding scripts: %s", err.Error())
+	}
+	appcfg.ArtifactType = "tar.gz"
+	dep := newTestDeployment(t, "app", &appcfg)
+
+	var lines []string
+	output := func(stream, line string) {
+		lines = append(lines, stream+": "+line)
+	}
+	dep.SetEnv("prod")
+	hc := &HookContext{PreviousVersion: "0.9.0", Metadata: map[string]string{"digest": "abc123"}}
+
+	// A phase without a script succeeds without running anything.
+	if cmdline, err := dep.RunHook(pdconfig.KHOOK_ONFAILURE, "1.0.0", hc, output); cmdline != "" || err != nil {
+		t.Errorf("RunHook without a script returned %q, %v", cmdline, err)
+	}
+
+	// A script that exits non-zero fails, even before the version is extracted.
+	if _, err := dep.RunHook(pdconfig.KHOOK_PREDEPLOY, "1.0.0", hc, output); err == nil {
+		t.Errorf("RunHook should have failed with a non-zero exit")
+	}
+
+	// Output to stderr alone does not fail a script, and all output is passed on
+	// line by line. Scripts see their own environment, not that of the daemon.
+	lines = nil
+	os.Setenv("PULLDEPLOY_TEST_LEAK", "yes")
+	defer os.Unsetenv("PULLDEPLOY_TEST_LEAK")
+	if _, err := dep.RunHook(pdconfig.KHOOK_POSTDEPLOY, "1.0.0", hc, output); err != nil {
+		t.Errorf("RunHook failed: %s", err.Error())
+	}
+	expected := []string{"stderr: warning", "stdout: abc123", "stdout: app prod 1.0.0 0.9.0", "stdout: leaked="}
+	sort.Strings(lines)
+	if fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Errorf("RunHook output was %q, expected %q", lines, expected)
+	}
+
+	// A script that runs too long is killed, along with the processes it started.
+	start := time.Now()
+	if _, err := dep.RunHook(pdconfig.KHOOK_PRERELEASE, "1.0.0", hc, output); err == nil {
+		t.Errorf("RunHook should have failed with a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunHook took %s to time out", elapsed)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+
+	// Metadata keys become valid environment variable names, or are dropped.
+	for key, expected := range map[string]string{
+		"digest":    "DIGEST",
+		"build-id":  "BUILD_ID",
+		"git.sha 1": "GIT_SHA_1",
+		"a=b":       "A_B",
+		"-.":        "",
+		"":          "",
+	} {
+		if name := envName(key); name != expected {
+			t.Errorf("envName(%q) returned %q, expected %q", key, name, expected)
+		}
+	}
+}
+
+func TestSubstituteVars(t *testing.T) {
+
+	values := varValues{appName: "app", envName: "prod", version: "1.0.1", priorVersion: "1.0.0",
+		hostName: "host1", baseDir: "/srv/app", currentDir: "/srv/app/current",
+		artifactPath: "/srv/app/artifact/app-1.0.1.tar.gz", versionDir: "/srv/app/release/1.0.1"}
+
+	args := substituteVars([]string{"#VERSIONDIR#", "--dir=#VERSIONDIR#/bin", "#APPNAME#-#ENV#@#HOSTNAME#",
+		"#PRIORVERSION#..#VERSION#", "#BASEDIR# #CURRENTDIR# #ARTIFACTPATH#", "#UNKNOWN#", "#"}, values)
+	expected := []string{"/srv/app/release/1.0.1", "--dir=/srv/app/release/1.0.1/bin", "app-prod@host1",
+		"1.0.0..1.0.1", "/srv/app /srv/app/current /srv/app/artifact/app-1.0.1.tar.gz", "#UNKNOWN#", "#"}
+	if fmt.Sprint(args) != fmt.Sprint(expected) {
+		t.Errorf("substituteVars returned %q, expected %q", args, expected)
+	}
+
+	// Every variable known to the configuration is substituted.
+	for token := range pdconfig.SubstitutionVars {
+		if values.substitute(token) == token {
+			t.Errorf("Variable %s is not substituted", token)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+
+	appcfg := &pdconfig.AppConfig{ArtifactType: "tar.gz", Templates: []string{"conf/app.conf"}}
+	dep := newTestDeployment(t, "app", appcfg)
+	dep.SetEnv("prod")
+	vars := map[string]interface{}{"db_host": "db.example.com"}
+	metadata := map[string]string{"digest": "abc123"}
+
+	// Utility helper to set up a release directory holding a template.
+	makeRelease := func(version, text string) string {
+		confDir := dep.releaseDir + "/" + version + "/conf"
+		if err := os.MkdirAll(confDir, 0755); err != nil {
+			t.Fatalf("Error creating release directory: %s", err.Error())
+		}
+		if err := ioutil.WriteFile(confDir+"/app.conf", []byte(text), 0644); err != nil {
+			t.Fatalf("Error writing template: %s", err.Error())
+		}
+		return confDir + "/app.conf"
+	}
+
+	// A template is rendered in place, with restrictive permissions.
+	confPath := makeRelease("1.0.0", "{{.App}} {{.Env}} {{.Version}} {{.Metadata.digest}} {{.Vars.db_host}}")
+	if err := dep.RenderTemplates("1.0.0", vars, metadata); err != nil {
+		t.Errorf("RenderTemplates failed: %s", err.Error())
+	}
+	if text, _ := ioutil.ReadFile(confPath); string(text) != "app prod 1.0.0 abc123 db.example.com" {
+		t.Errorf("RenderTemplates rendered %q", text)
+	}
+	if fi, err := os.Stat(confPath); err != nil {
+		t.Errorf("Rendered template missing: %s", err.Error())
+	} else if fi.Mode().Perm() != kTEMPLATE_PERM {
+		t.Errorf("Rendered template has mode %v, expected %v", fi.Mode().Perm(), os.FileMode(kTEMPLATE_PERM))
+	}
+
+	// A template that refers to an undefined value fails, and the release is removed.
+	makeRelease("1.0.1", "{{.Vars.db_password}}")
+	if err := dep.RenderTemplates("1.0.1", vars, metadata); err == nil {
+		t.Errorf("RenderTemplates should have failed with an undefined value")
+	}
+	if _, exists := makeReleasePath(dep.releaseDir, "1.0.1"); exists {
+		t.Errorf("Release directory present after failed rendering")
+	}
+
+	// A template may not lead out of the release directory.
+	confPath = makeRelease("1.0.2", "")
+	os.Remove(confPath)
+	outside := appcfg.BaseDir + "/outside.conf"
+	ioutil.WriteFile(outside, []byte("{{.Vars.db_host}}"), 0644)
+	os.Symlink(outside, confPath)
+	if err := dep.RenderTemplates("1.0.2", vars, metadata); err == nil {
+		t.Errorf("RenderTemplates should have refused a link out of the release directory")
+	}
+	if text, _ := ioutil.ReadFile(outside); string(text) != "{{.Vars.db_host}}" {
+		t.Errorf("RenderTemplates rendered a file outside the release directory")
+	}
+}
+
+func TestLinkShared(t *testing.T) {
+
+	dep := newTestDeployment(t, "app", &pdconfig.AppConfig{ArtifactType: "tar.gz", Shared: []string{"log", "var/uploads"}})
+
+	// The artifact's own log directory is replaced, and the shared directories created.
+	for _, version := range []string{"1.0.0", "1.0.1"} {
+		os.MkdirAll(dep.releaseDir+"/"+version+"/log", 0755)
+		if err := dep.LinkShared(version); err != nil {
+			t.Errorf("LinkShared failed: %s", err.Error())
+		}
+	}
+	for _, name := range []string{"log", "var/uploads"} {
+		if fi, err := os.Stat(dep.baseDir + "/shared/" + name); err != nil || !fi.IsDir() {
+			t.Errorf("Shared directory %q not created", name)
+		}
+	}
+
+	// What one release writes to a shared directory, the next one sees.
+	if err := ioutil.WriteFile(dep.releaseDir+"/1.0.0/var/uploads/file", []byte("data"), 0644); err != nil {
+		t.Errorf("Error writing to shared directory: %s", err.Error())
+	}
+	if data, err := ioutil.ReadFile(dep.releaseDir + "/1.0.1/var/uploads/file"); err != nil || string(data) != "data" {
+		t.Errorf("Shared file not visible in the next release: %v", err)
+	}
+
+	// Removing a release leaves the shared directories intact.
+	if err := dep.Remove("1.0.0"); err != nil {
+		t.Errorf("Remove failed: %s", err.Error())
+	}
+	if _, err := os.Stat(dep.baseDir + "/shared/var/uploads/file"); err != nil {
+		t.Errorf("Shared file removed along with a release")
+	}
+}
+
+func TestJournal(t *testing.T) {
+
+	dep := newTestDeployment(t, "app", &pdconfig.AppConfig{ArtifactType: "tar.gz"})
+	deploy := func(version string) {
+		if fp, err := os.Open("../data/testdata/stubapp.tar.gz"); err == nil {
+			if err := dep.WriteArtifact(version, fp); err != nil {
+				t.Errorf("WriteArtifact failed: %s", err.Error())
+			}
+		} else {
+			t.Fatalf("Could not open test data file for reading: %s", err.Error())
+		}
+		if err := dep.Extract(version); err != nil {
+			t.Errorf("Extract failed: %s", err.Error())
+		}
+	}
+
+	// Without a journal, every release directory is deployed.
+	deploy("1.0.0")
+	deploy("1.0.1")
+	if versionList := dep.GetDeployedVersions(); len(versionList) != 2 {
+		t.Errorf("GetDeployedVersions failed: expected 2, got %v", versionList)
+	}
+
+	// Once the journal is written, only ready versions are deployed.
+	dep.SetStage("1.0.2", KSTAGE_VERIFIED)
+	deploy("1.0.2")
+	dep.SetStage("1.0.2", KSTAGE_EXTRACTED)
+	deploy("1.0.3")
+	dep.SetStage("1.0.3", KSTAGE_HOOKS_RAN)
+	if versionList := dep.GetDeployedVersions(); len(versionList) != 2 {
+		t.Errorf("GetDeployedVersions failed: expected 2, got %v", versionList)
+	}
+	if stage := dep.GetStage("1.0.0"); stage != KSTAGE_READY {
+		t.Errorf("Existing version should be %q; found %q", KSTAGE_READY, stage)
+	}
+
+	// Recovery completes one version, and cleans up the other for deploying afresh.
+	resumed, cleaned, err := dep.Recover()
+	if err != nil {
+		t.Errorf("Recover failed: %s", err.Error())
+	}
+	if len(resumed) != 1 || resumed[0] != "1.0.3" {
+		t.Errorf("Recover should resume %q; resumed %v", "1.0.3", resumed)
+	}
+	if len(cleaned) != 1 || cleaned[0] != "1.0.2" {
+		t.Errorf("Recover should clean up %q; cleaned %v", "1.0.2", cleaned)
+	}
+	if _, exists := makeReleasePath(dep.releaseDir, "1.0.2"); exists {
+		t.Errorf("Incomplete release directory not removed")
+	}
+	if stage := dep.GetStage("1.0.2"); stage != KSTAGE_VERIFIED {
+		t.Errorf("Incomplete version should be %q; found %q", KSTAGE_VERIFIED, stage)
+	}
+	if versionList := dep.GetDeployedVersions(); len(versionList) != 3 {
+		t.Errorf("GetDeployedVersions failed: expected 3, got %v", versionList)
+	}
+
+	// Removed versions are forgotten.
+	if err := dep.Remove("1.0.0"); err != nil {
+		t.Errorf("Remove failed: %s", err.Error())
+	}
+	if stage := dep.GetStage("1.0.0"); stage != "" {
+		t.Errorf("Removed version should have no stage; found %q", stage)
+	}
+}
+
+func TestLock(t *testing.T) {
+
+	appcfg := &pdconfig.AppConfig{ArtifactType: "tar.gz"}
+	dep1 := newTestDeployment(t, "app", appcfg)
+	dep2 := newTestDeployment(t, "app", appcfg)
+
+	// Only one holder at a time, and the other is told who holds it.
+	if err := dep1.Lock(); err != nil {
+		t.Fatalf("Lock failed: %s", err.Error())
+	}
+	if err := dep2.Lock(); err == nil {
+		t.Errorf("Second Lock did not fail")
+	} else if pid := strconv.Itoa(os.Getpid()); !strings.Contains(err.Error(), "process "+pid) {
+		t.Errorf("Lock error should name process %s: %s", pid, err.Error())
+	}
+
+	// Once released, the lock may be taken again.
+	dep1.Unlock()
+	if err := dep2.Lock(); err != nil {
+		t.Errorf("Lock after Unlock failed: %s", err.Error())
+	}
+	dep2.Unlock()
+}
@@ -0,0 +1,226 @@
+package deployment
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long an application's script may run, unless configured otherwise.
+const kHOOK_TIMEOUT = 5 * time.Minute
+
+// The search path given to scripts.
+const kHOOK_PATH = "/usr/local/bin:/usr/bin:/bin:/usr/local/sbin:/usr/sbin:/sbin"
+
+// The longest line of script output passed on intact; longer lines are split.
+const kHOOK_MAX_LINE = 4096
+
+// How long to wait for the output of a killed script to close, in case something
+// it started has left its process group.
+const kHOOK_WAIT_DELAY = 5 * time.Second
+
+// HookContext describes the deployment step during which a script runs.
+type HookContext struct {
+	PreviousVersion string            // The version that was current before this step, if any
+	Metadata        map[string]string // Information about the version from the repository
+}
+
+/*
+RunHook executes the script configured for the given KHOOK_* phase of deploying
+a version, if there is one. It returns a line for the log, and an error if the
+script could not be run, exited non-zero, or ran longer than its timeout, in
+which case its whole process group is killed. Each line the script writes is
+passed to output as it is written, along with "stdout" or "stderr"; output is
+called for one line at a time.
+
+Scripts run in the release directory of the version, or in the base directory
+of the application if the version has not been extracted. When the daemon runs
+as root, they run as the user and group that own the deployment. They do not
+inherit the environment of the daemon; instead they are given:
+
+	PATH                         A standard search path
+	HOME, USER, LOGNAME          Those of the user running the script
+	PULLDEPLOY_APP               The name of the application
+	PULLDEPLOY_ENV               The environment being tracked
+	PULLDEPLOY_PHASE             The phase at which the script runs, such as "postdeploy"
+	PULLDEPLOY_VERSION           The version being deployed, released or removed
+	PULLDEPLOY_PREVIOUS_VERSION  The version that was current before this step
+	PULLDEPLOY_BASEDIR           The directory holding all the application's files
+	PULLDEPLOY_VERSIONDIR        The release directory of the version
+	PULLDEPLOY_CURRENTDIR        The "current" symlink
+	PULLDEPLOY_ARTIFACT          The artifact of the version
+	PULLDEPLOY_VERSION_<KEY>     Each item of version metadata, such as PULLDEPLOY_VERSION_DIGEST
+
+In the name of an item of metadata, each character other than a letter, digit
+or underscore becomes an underscore; an item whose name has no letter or digit
+is not passed on.
+
+The same values may be substituted into the command and its arguments; see
+pdconfig.SubstitutionVars.
+*/
+func (d *Deployment) RunHook(phase, version string, hc *HookContext, output func(stream, line string)) (string, error) {
+	script, found := d.cfg.Scripts[phase]
+	if !found || script.Cmd == "" {
+		return "", nil
+	}
+	if os.Geteuid() == 0 && d.cfg.Insecure {
+		return "", fmt.Errorf(
+			"Refusing to execute %s command from insecure %q configuration as root",
+			phase, d.appName)
+	}
+	if os.Geteuid() == 0 && d.cfg.User != "" && d.uid == 0 && d.cfg.User != "root" {
+		return "", fmt.Errorf("Refusing to execute %s command as root: unknown user %q", phase, d.cfg.User)
+	}
+
+	if hc == nil {
+		hc = new(HookContext)
+	}
+	if output == nil {
+		output = func(stream, line string) {}
+	}
+
+	// Lines from stdout and stderr arrive concurrently, but are passed on one at a time.
+	var outputMu sync.Mutex
+	emit := func(stream, line string) {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		output(stream, line)
+	}
+
+	values := d.varValues(version, hc.PreviousVersion)
+	curDir := values.versionDir
+	if _, exists := makeReleasePath(d.releaseDir, version); !exists {
+		curDir = d.baseDir
+	}
+	timeout := kHOOK_TIMEOUT
+	if script.Timeout > 0 {
+		timeout = time.Duration(script.Timeout) * time.Second
+	}
+
+	// Describe the deployment to the script.
+	env := []string{
+		"PATH=" + kHOOK_PATH,
+		"PULLDEPLOY_APP=" + d.appName,
+		"PULLDEPLOY_ENV=" + values.envName,
+		"PULLDEPLOY_PHASE=" + phase,
+		"PULLDEPLOY_VERSION=" + version,
+		"PULLDEPLOY_PREVIOUS_VERSION=" + hc.PreviousVersion,
+		"PULLDEPLOY_BASEDIR=" + values.baseDir,
+		"PULLDEPLOY_VERSIONDIR=" + values.versionDir,
+		"PULLDEPLOY_CURRENTDIR=" + values.currentDir,
+		"PULLDEPLOY_ARTIFACT=" + values.artifactPath,
+	}
+	for key, value := range hc.Metadata {
+		if name := envName(key); name != "" {
+			env = append(env, "PULLDEPLOY_VERSION_"+name+"="+value)
+		}
+	}
+
+	// Run as the owner of the deployment, if able to switch to that user.
+	var cred *syscall.Credential
+	uid := os.Geteuid()
+	if uid == 0 && d.uid != 0 {
+		cred = &syscall.Credential{Uid: uint32(d.uid), Gid: uint32(d.gid)}
+		uid = d.uid
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		env = append(env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	}
+
+	cmdName := values.substitute(script.Cmd)
+	cmdlineArgs := substituteVars(script.Args, values)
+	cmdline := cmdName + " " + strings.Join(cmdlineArgs, " ")
+	logLine := fmt.Sprintf("Executed %q in %s as uid %d", cmdline, curDir, uid)
+
+	cmd := exec.Command(cmdName, cmdlineArgs...)
+	cmd.Dir = curDir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+	cmd.WaitDelay = kHOOK_WAIT_DELAY
+	stdout := &lineWriter{emit: func(line string) { emit("stdout", line) }}
+	stderr := &lineWriter{emit: func(line string) { emit("stderr", line) }}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return logLine, fmt.Errorf("%q failed: %s", cmdline, err.Error())
+	}
+
+	// On timeout, kill the script along with anything it has started.
+	pgid := cmd.Process.Pid
+	timer := time.AfterFunc(timeout, func() { syscall.Kill(-pgid, syscall.SIGKILL) })
+	err := cmd.Wait()
+	timedOut := !timer.Stop()
+	stdout.flush()
+	stderr.flush()
+
+	// A script that exited cleanly has succeeded, even if something it started in
+	// the background held its output open.
+	if timedOut {
+		return logLine, fmt.Errorf("%q killed after %s", cmdline, timeout)
+	} else if err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		return logLine, fmt.Errorf("%q failed: %s", cmdline, err.Error())
+	}
+	return logLine, nil
+}
+
+// envName converts a metadata key to the form of an environment variable name,
+// returning "" if it holds no letter or digit.
+func envName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(key))
+	if strings.Trim(name, "_") == "" {
+		return ""
+	}
+	return name
+}
+
+// lineWriter passes each line written to it to a function, without its newline.
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	emit func(line string)
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 || i > kHOOK_MAX_LINE {
+			if len(lw.buf) < kHOOK_MAX_LINE {
+				break
+			}
+			i = kHOOK_MAX_LINE
+		}
+		lw.emit(strings.TrimRight(string(lw.buf[:i]), "\r"))
+		if i < len(lw.buf) && lw.buf[i] == '\n' {
+			i++
+		}
+		lw.buf = lw.buf[i:]
+	}
+	return len(p), nil
+}
+
+// flush passes on any final line that lacks a newline.
+func (lw *lineWriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.buf) > 0 {
+		lw.emit(string(lw.buf))
+		lw.buf = nil
+	}
+}
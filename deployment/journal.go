@@ -0,0 +1,157 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+/*
+The journal records the stage reached by each version being deployed, so that a
+daemon stopped part way through, for example while extracting, does not later
+take a half-populated release directory to be deployed. Only the versions that
+are ready are reported as deployed; see Recover.
+
+A host deployed to before the journal was kept has none, and every release
+directory is taken to be ready, until the journal is first written.
+*/
+const kJOURNALFILE = "journal"
+
+// The stages through which a version passes as it is deployed, as recorded in the journal.
+const (
+	KSTAGE_FETCHED   = "fetched"   // The artifact and its HMAC have been written
+	KSTAGE_VERIFIED  = "verified"  // The artifact matches its HMAC
+	KSTAGE_EXTRACTED = "extracted" // The release directory is complete
+	KSTAGE_HOOKS_RAN = "hooks-ran" // The post-deploy command has run
+	KSTAGE_READY     = "ready"     // The version may be released
+)
+
+// journalEntry records how far the deployment of a version has progressed.
+type journalEntry struct {
+	Stage   string
+	Updated time.Time
+}
+
+// loadJournal reads the journal, and indicates whether one exists.
+func (d *Deployment) loadJournal() (map[string]*journalEntry, bool, error) {
+	journal := make(map[string]*journalEntry)
+	data, err := ioutil.ReadFile(path.Join(d.baseDir, kJOURNALFILE))
+	if os.IsNotExist(err) {
+		if fi, err := ioutil.ReadDir(d.releaseDir); err == nil {
+			for _, v := range fi {
+				journal[v.Name()] = &journalEntry{KSTAGE_READY, v.ModTime()}
+			}
+		}
+		return journal, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, true, fmt.Errorf("Journal is corrupt: %s", err.Error())
+	}
+	return journal, true, nil
+}
+
+// saveJournal replaces the journal.
+func (d *Deployment) saveJournal(journal map[string]*journalEntry) error {
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(d.baseDir, kJOURNALFILE), append(data, '\n'), 0644, d.uid, d.gid)
+}
+
+// SetStage records that the deployment of a version has reached one of the KSTAGE_* stages.
+func (d *Deployment) SetStage(version, stage string) error {
+	journal, _, err := d.loadJournal()
+	if err != nil {
+		return err
+	}
+	journal[version] = &journalEntry{stage, time.Now()}
+	if err := d.saveJournal(journal); err != nil {
+		return fmt.Errorf("Cannot record stage %q of version %q: %s", stage, version, err.Error())
+	}
+	return nil
+}
+
+// GetStage returns the stage the deployment of a version has reached, if any.
+func (d *Deployment) GetStage(version string) string {
+	if journal, _, err := d.loadJournal(); err == nil {
+		if entry, found := journal[version]; found {
+			return entry.Stage
+		}
+	}
+	return ""
+}
+
+// forgetStage removes a version from the journal, if one is kept.
+func (d *Deployment) forgetStage(version string) error {
+	journal, exists, err := d.loadJournal()
+	if err != nil || !exists {
+		return err
+	}
+	if _, found := journal[version]; !found {
+		return nil
+	}
+	delete(journal, version)
+	return d.saveJournal(journal)
+}
+
+/*
+Recover brings the journal and the release directories into agreement after the
+daemon was stopped part way through deploying a version, and returns the versions
+that were resumed and those that were cleaned up.
+
+A version whose post-deploy command had already run needs only to be marked
+ready, and is resumed. Any other incomplete version has its release directory
+removed, along with a release directory that the journal does not mention, so
+that it is deployed afresh; an artifact already fetched is kept, as it is checked
+against its HMAC again before use.
+*/
+func (d *Deployment) Recover() ([]string, []string, error) {
+
+	var resumed, cleaned []string
+	journal, exists, err := d.loadJournal()
+	if err != nil || !exists {
+		return nil, nil, err
+	}
+
+	// Every release directory must belong to a version that is ready.
+	if fi, err := ioutil.ReadDir(d.releaseDir); err == nil {
+		for _, v := range fi {
+			version := v.Name()
+			if entry, found := journal[version]; found && entry.Stage == KSTAGE_HOOKS_RAN {
+				entry.Stage, entry.Updated = KSTAGE_READY, time.Now()
+				resumed = append(resumed, version)
+			} else if !found || entry.Stage != KSTAGE_READY {
+				if version == d.GetCurrentLink() {
+					continue
+				}
+				if err := os.RemoveAll(path.Join(d.releaseDir, version)); err != nil {
+					return resumed, cleaned, fmt.Errorf("Cannot remove incomplete version %q: %s", version, err.Error())
+				}
+				if found && entry.Stage == KSTAGE_EXTRACTED {
+					entry.Stage, entry.Updated = KSTAGE_VERIFIED, time.Now()
+				}
+				cleaned = append(cleaned, version)
+			}
+		}
+	}
+
+	// Forget the versions that have been removed since they were recorded, and
+	// those that have gone no further than fetching an artifact that is now gone.
+	for version, entry := range journal {
+		_, extracted := makeReleasePath(d.releaseDir, version)
+		if !extracted && (entry.Stage == KSTAGE_READY || !d.ArtifactPresent(version)) {
+			delete(journal, version)
+		}
+	}
+
+	sort.Strings(resumed)
+	sort.Strings(cleaned)
+	return resumed, cleaned, d.saveJournal(journal)
+}
@@ -0,0 +1,69 @@
+package deployment
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+The lock file in the base directory of an application is locked by the daemon
+while it changes the deployment, so that two daemons sharing a BASEDIR, such as
+one started by hand alongside one started by init, never extract into the same
+release directory or switch the "current" link at the same time. The lock is
+released when the file is closed, which the kernel does if the daemon dies; the
+file holds the process ID of the last holder, for reporting.
+*/
+const kLOCKFILE = "lock"
+
+// Lock takes the lock on the deployment without waiting, and returns an error
+// naming the process that holds it if it is already held.
+func (d *Deployment) Lock() error {
+
+	if d.lock != nil {
+		return nil
+	}
+
+	lockPath := path.Join(d.baseDir, kLOCKFILE)
+	fp, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Cannot open lock file: %s", err.Error())
+	}
+	if err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer fp.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("Deployment of %q is locked by %s (%s)", d.appName, lockHolder(fp), lockPath)
+		}
+		return fmt.Errorf("Cannot lock %q: %s", lockPath, err.Error())
+	}
+
+	// Record the holder of the lock.
+	fp.Truncate(0)
+	fp.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	setOwner(lockPath, d.uid, d.gid)
+
+	d.lock = fp
+	return nil
+}
+
+// Unlock releases the lock on the deployment, if held.
+func (d *Deployment) Unlock() {
+	if d.lock != nil {
+		d.lock.Close()
+		d.lock = nil
+	}
+}
+
+// lockHolder describes the process recorded in a lock file.
+func lockHolder(fp *os.File) string {
+	if data, err := ioutil.ReadAll(fp); err == nil {
+		if pid := strings.TrimSpace(string(data)); pid != "" {
+			return "process " + pid
+		}
+	}
+	return "another process"
+}
@@ -0,0 +1,91 @@
+package deployment
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+LinkShared replaces each of the shared directories configured for the application,
+within the release directory of a version, with a link to the directory of the
+same name under the "shared" directory, which is created, with the owner of the
+deployment, on first use. Whatever the artifact held at that path is discarded.
+
+If any shared directory cannot be linked, the release directory is removed, so
+that the version is not taken to be deployed.
+*/
+func (d *Deployment) LinkShared(version string) error {
+
+	if len(d.cfg.Shared) == 0 {
+		return nil
+	}
+	versionDir, exists := makeReleasePath(d.releaseDir, version)
+	if !exists {
+		return fmt.Errorf("Release directory does not exist: %q", versionDir)
+	}
+
+	for _, name := range d.cfg.Shared {
+		if err := d.linkShared(versionDir, path.Clean(name)); err != nil {
+			os.RemoveAll(versionDir)
+			return fmt.Errorf("Cannot link shared directory %q: %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// linkShared links a single shared directory into a release directory.
+func (d *Deployment) linkShared(versionDir, name string) error {
+
+	// Create the shared directory, and any of its parents, if necessary.
+	sharedPath := path.Join(d.baseDir, kSHAREDDIR, name)
+	if err := d.makeDirAll(sharedPath); err != nil {
+		return err
+	}
+
+	// Ensure that the link has a parent in the release directory, without
+	// following any link the artifact may have put in its place.
+	linkPath := path.Join(versionDir, name)
+	dir := versionDir
+	for _, elem := range strings.Split(path.Dir(name), "/") {
+		if elem == "." {
+			break
+		}
+		dir = path.Join(dir, elem)
+		if fi, err := os.Lstat(dir); err == nil && !fi.IsDir() {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			if err := makeDir(dir, d.uid, d.gid, 0755); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Replace whatever is there with the link.
+	if err := os.RemoveAll(linkPath); err != nil {
+		return err
+	}
+	return os.Symlink(sharedPath, linkPath)
+}
+
+// makeDirAll creates a directory below the base directory, along with any
+// missing parents, all owned by the owner of the deployment.
+func (d *Deployment) makeDirAll(dir string) error {
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("not a directory: %q", dir)
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != d.baseDir {
+		if err := d.makeDirAll(parent); err != nil {
+			return err
+		}
+	}
+	return makeDir(dir, d.uid, d.gid, 0755)
+}
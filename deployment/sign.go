@@ -23,3 +23,45 @@ func CalculateHMAC(rc io.ReadCloser, hmacCalculator hash.Hash) []byte {
 
 	return hmacCalculator.Sum(nil)
 }
+
+// HMACWriter calculates an HMAC over the data written to it, in the same pass
+// as some other use of the data, such as an upload.
+//
+// It produces the same result as CalculateHMAC: the data is hashed in blocks of
+// 16384 bytes, and a final short block is hashed as a full block, padded with
+// whatever the preceding block left in the buffer.
+type HMACWriter struct {
+	hmacCalculator hash.Hash
+	buf            []byte
+	n              int
+}
+
+// NewHMACWriter returns an HMACWriter that uses the given HMAC calculator.
+func NewHMACWriter(hmacCalculator hash.Hash) *HMACWriter {
+	hmacCalculator.Reset()
+	return &HMACWriter{hmacCalculator, make([]byte, 16384), 0}
+}
+
+// Write adds data to the HMAC.
+func (hw *HMACWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		copied := copy(hw.buf[hw.n:], p)
+		hw.n += copied
+		p = p[copied:]
+		if hw.n == len(hw.buf) {
+			hw.hmacCalculator.Write(hw.buf)
+			hw.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Sum returns the HMAC of all the data written.
+func (hw *HMACWriter) Sum() []byte {
+	if hw.n > 0 {
+		hw.hmacCalculator.Write(hw.buf)
+		hw.n = 0
+	}
+	return hw.hmacCalculator.Sum(nil)
+}
@@ -0,0 +1,115 @@
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// The permissions of rendered templates, which may well hold secrets.
+const kTEMPLATE_PERM = 0640
+
+// TemplateData is the data with which the templates of an application are rendered.
+type TemplateData struct {
+	App      string                 // The name of the application
+	Env      string                 // The environment being tracked
+	Version  string                 // The version being deployed
+	Hostname string                 // The name of the local host
+	Metadata map[string]string      // Information about the version from the repository
+	Vars     map[string]interface{} // The values for the environment
+}
+
+/*
+RenderTemplates renders the templates configured for the application in place,
+within the release directory of a version, using text/template. The templates
+are given a TemplateData, with the values for the environment in Vars, so that,
+for example:
+
+	db_host: {{ .Vars.db_host }}
+
+A template that refers to a value that is not defined is an error. Rendered
+files belong to the owner of the deployment, and are readable only by it and
+its group.
+
+If any template cannot be rendered, the release directory is removed, so that
+the version is not taken to be deployed.
+*/
+func (d *Deployment) RenderTemplates(version string, vars map[string]interface{}, metadata map[string]string) error {
+
+	if len(d.cfg.Templates) == 0 {
+		return nil
+	}
+	versionDir, exists := makeReleasePath(d.releaseDir, version)
+	if !exists {
+		return fmt.Errorf("Release directory does not exist: %q", versionDir)
+	}
+
+	hostName, _ := os.Hostname()
+	data := &TemplateData{d.appName, d.envName, version, hostName, metadata, vars}
+	for _, name := range d.cfg.Templates {
+		if err := d.renderTemplate(versionDir, name, data); err != nil {
+			os.RemoveAll(versionDir)
+			return fmt.Errorf("Cannot render template %q: %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// renderTemplate renders a single template in place.
+func (d *Deployment) renderTemplate(versionDir, name string, data *TemplateData) error {
+
+	// The template must be a regular file within the release directory, not a link out of it.
+	realDir, err := filepath.EvalSymlinks(versionDir)
+	if err != nil {
+		return err
+	}
+	realPath, err := filepath.EvalSymlinks(path.Join(versionDir, name))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(realPath, realDir+"/") {
+		return errors.New("not within the release directory")
+	}
+	if fi, err := os.Stat(realPath); err != nil {
+		return err
+	} else if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+
+	text, err := ioutil.ReadFile(realPath)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return err
+	}
+
+	// Render into a temporary file, which replaces the template once complete.
+	fp, err := ioutil.TempFile(path.Dir(realPath), ".pulldeploy-template")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if err := tmpl.Execute(fp, data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(fp.Name(), kTEMPLATE_PERM); err != nil {
+		return err
+	}
+	if err := setOwner(fp.Name(), d.uid, d.gid); err != nil {
+		return err
+	}
+
+	return os.Rename(fp.Name(), realPath)
+}
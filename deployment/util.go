@@ -3,6 +3,7 @@ package deployment
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
@@ -21,29 +22,44 @@ func absPath(candidate string) string {
 	return s
 }
 
-// The values that are to be substituted into command line arguments.
+// The values that are to be substituted into commands and their arguments.
 type varValues struct {
+	appName      string // var: #APPNAME#
+	envName      string // var: #ENV#
+	version      string // var: #VERSION#
+	priorVersion string // var: #PRIORVERSION#
+	hostName     string // var: #HOSTNAME#
+	baseDir      string // var: #BASEDIR#
+	currentDir   string // var: #CURRENTDIR#
 	artifactPath string // var: #ARTIFACTPATH#
 	versionDir   string // var: #VERSIONDIR#
 }
 
+// Utility helper to perform substitutions for supported variables, wherever they appear.
+func (values varValues) substitute(s string) string {
+	return strings.NewReplacer(
+		"#APPNAME#", values.appName,
+		"#ENV#", values.envName,
+		"#VERSION#", values.version,
+		"#PRIORVERSION#", values.priorVersion,
+		"#HOSTNAME#", values.hostName,
+		"#BASEDIR#", values.baseDir,
+		"#CURRENTDIR#", values.currentDir,
+		"#ARTIFACTPATH#", values.artifactPath,
+		"#VERSIONDIR#", values.versionDir,
+	).Replace(s)
+}
+
 // Utility helper to perform substitutions for supported command arguments.
 func substituteVars(argsIn []string, values varValues) []string {
 	var argsOut = make([]string, 0)
 	for _, s := range argsIn {
-		switch s {
-		case "#ARTIFACTPATH#":
-			argsOut = append(argsOut, values.artifactPath)
-		case "#VERSIONDIR#":
-			argsOut = append(argsOut, values.versionDir)
-		default:
-			argsOut = append(argsOut, s)
-		}
+		argsOut = append(argsOut, values.substitute(s))
 	}
 	return argsOut
 }
 
-// Utility helper to execute a system command.
+// Utility helper to execute a system command, which fails if it cannot be run or exits non-zero.
 func sysCommand(curDir string, command string, args []string) (string, error) {
 
 	var stdout bytes.Buffer
@@ -61,33 +77,20 @@ func sysCommand(curDir string, command string, args []string) (string, error) {
 	err := cmd.Run()
 
 	// Format the results for easy logging.
-	var logLine string
-	var logErr error
 	cmdline := command + " " + strings.Join(args, " ")
-	if stdout.Len() == 0 {
-		if stderr.Len() == 0 {
-			logLine = fmt.Sprintf("Executed %q in %s", cmdline, curDir)
-		} else {
-			logLine = fmt.Sprintf("Executed %q in %s\nstderr=%q", cmdline, curDir,
-				strings.TrimSpace(stderr.String()))
-			if err != nil {
-				logErr = fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
-			} else {
-				logErr = fmt.Errorf(strings.TrimSpace(stderr.String()))
-			}
-		}
-	} else {
-		if stderr.Len() == 0 {
-			logLine = fmt.Sprintf("Executed %q in %s\nstdout=%q", cmdline, curDir,
-				strings.TrimSpace(stdout.String()))
+	logLine := fmt.Sprintf("Executed %q in %s", cmdline, curDir)
+	if stdout.Len() > 0 {
+		logLine += fmt.Sprintf("\nstdout=%q", strings.TrimSpace(stdout.String()))
+	}
+	if stderr.Len() > 0 {
+		logLine += fmt.Sprintf("\nstderr=%q", strings.TrimSpace(stderr.String()))
+	}
+	var logErr error
+	if err != nil {
+		if stderr.Len() > 0 {
+			logErr = fmt.Errorf("%q failed: %s: %s", cmdline, err.Error(), strings.TrimSpace(stderr.String()))
 		} else {
-			logLine = fmt.Sprintf("Executed %q in %s\nstdout=%q\nstderr=%q", cmdline, curDir,
-				strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()))
-			if err != nil {
-				logErr = fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
-			} else {
-				logErr = fmt.Errorf(strings.TrimSpace(stderr.String()))
-			}
+			logErr = fmt.Errorf("%q failed: %s", cmdline, err.Error())
 		}
 	}
 
@@ -103,6 +106,34 @@ func makeDir(name string, uid, gid int, perm os.FileMode) error {
 	}
 }
 
+// Utility helper to replace a small file atomically, by writing a temporary
+// file and renaming it into place.
+func writeFileAtomic(name string, data []byte, perm os.FileMode, uid, gid int) error {
+	fp, err := ioutil.TempFile(path.Dir(name), "."+path.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(fp.Name(), perm); err != nil {
+		return err
+	}
+	if err := setOwner(fp.Name(), uid, gid); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), name)
+}
+
 // Utility helper to set the owner of a file.
 func setOwner(name string, uid, gid int) error {
 
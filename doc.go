@@ -14,23 +14,35 @@ Commands:
         pulldeploy initrepo -app=<app>
         pulldeploy addenv   -app=<app> envname [envname envname ...]
         pulldeploy rmenv    -app=<app> envname [envname envname ...]
-        pulldeploy set      -app=<app> -env=<env> [-keep=n]
+        pulldeploy set      -app=<app> -env=<env> [-keep=n] [-approvals=n] [-approvalttl=<duration>]
 
     Release management:
-        pulldeploy upload  -app=<app> -version=<version> [-disabled] <file>
+        pulldeploy upload  -app=<app> -version=<version> [-base=<version>] [-disabled] [-partsize=<MB>] <file>
         pulldeploy enable  -app=<app> -version=<version>
         pulldeploy disable -app=<app> -version=<version>
         pulldeploy purge   -app=<app> -version=<version>
-        pulldeploy deploy  -app=<app> -version=<version> -env=<env>
-        pulldeploy release -app=<app> -version=<version> -env=<env> [host1, host2, ...]
+        pulldeploy deploy  -app=<app> -version=<version> -env=<env> [-force]
+        pulldeploy release -app=<app> -version=<version> -env=<env> [-force] [host1, host2, ...]
+        pulldeploy lock    -app=<app> -env=<env> -reason=<reason> [-schedule=<cron> -duration=<duration>]
+        pulldeploy unlock  -app=<app> -env=<env> [-schedule=<cron>]
+
+    Release approval:
+        pulldeploy request-release -app=<app> -version=<version> -env=<env> [host1, host2, ...]
+        pulldeploy approve         -app=<app> -version=<version> -env=<env>
+        pulldeploy reject          -app=<app> -version=<version> -env=<env> [-reason=<reason>]
 
     Informational:
         pulldeploy list
         pulldeploy status -app=<app>
         pulldeploy listhosts -app=<app> -env=<env>
+        pulldeploy repo ls [-app=<app>]
+
+    Maintenance:
+        pulldeploy fsck   -app=<app> [-repair]
+        pulldeploy mirror -to=<accessmethod> [-from=<accessmethod>] [-app=<app>] [-prune] [-watch [-interval=<duration>]]
 
     Daemon:
-        pulldeploy daemon -env=<env> [-logfile=<logfilename>]
+        pulldeploy daemon [-env=<env>] [-logfile=<logfilename>] [-pidfile=<pidfilename>]
 */
 package main
 
@@ -52,23 +64,35 @@ Commands:
         pulldeploy initrepo -app=<app>
         pulldeploy addenv   -app=<app> envname [envname envname ...]
         pulldeploy rmenv    -app=<app> envname [envname envname ...]
-        pulldeploy set      -app=<app> -env=<env> [-keep=n]
+        pulldeploy set      -app=<app> -env=<env> [-keep=n] [-approvals=n] [-approvalttl=<duration>]
 
     Release management:
-        pulldeploy upload  -app=<app> -version=<version> [-disabled] <file>
+        pulldeploy upload  -app=<app> -version=<version> [-base=<version>] [-disabled] [-partsize=<MB>] <file>
         pulldeploy enable  -app=<app> -version=<version>
         pulldeploy disable -app=<app> -version=<version>
         pulldeploy purge   -app=<app> -version=<version>
-        pulldeploy deploy  -app=<app> -version=<version> -env=<env>
-        pulldeploy release -app=<app> -version=<version> -env=<env> [host1, host2, ...]
+        pulldeploy deploy  -app=<app> -version=<version> -env=<env> [-force]
+        pulldeploy release -app=<app> -version=<version> -env=<env> [-force] [host1, host2, ...]
+        pulldeploy lock    -app=<app> -env=<env> -reason=<reason> [-schedule=<cron> -duration=<duration>]
+        pulldeploy unlock  -app=<app> -env=<env> [-schedule=<cron>]
+
+    Release approval:
+        pulldeploy request-release -app=<app> -version=<version> -env=<env> [host1, host2, ...]
+        pulldeploy approve         -app=<app> -version=<version> -env=<env>
+        pulldeploy reject          -app=<app> -version=<version> -env=<env> [-reason=<reason>]
 
     Informational:
         pulldeploy list
         pulldeploy status -app=<app>
         pulldeploy listhosts -app=<app> -env=<env>
+        pulldeploy repo ls [-app=<app>]
+
+    Maintenance:
+        pulldeploy fsck   -app=<app> [-repair]
+        pulldeploy mirror -to=<accessmethod> [-from=<accessmethod>] [-app=<app>] [-prune] [-watch [-interval=<duration>]]
 
     Daemon:
-        pulldeploy daemon -env=<env> [-logfile=<logfilename>]
+        pulldeploy daemon [-env=<env>] [-logfile=<logfilename>] [-pidfile=<pidfilename>]
 `
 
 func showCommandHelp(command string) bool {
@@ -81,9 +105,9 @@ func showCommandHelp(command string) bool {
 	case "rmenv":
 		fmt.Println("usage: pulldeploy rmenv -app=<app> envname [envname envname ...]")
 	case "set":
-		fmt.Println("usage: pulldeploy set -app=<app> -env=<env> [-keep=n]")
+		fmt.Println("usage: pulldeploy set -app=<app> -env=<env> [-keep=n] [-approvals=n] [-approvalttl=<duration>]")
 	case "upload":
-		fmt.Println("usage: pulldeploy upload -app=<app> -version=<version> [-disabled] <file>")
+		fmt.Println("usage: pulldeploy upload -app=<app> -version=<version> [-base=<version>] [-disabled] [-partsize=<MB>] <file>")
 	case "enable":
 		fmt.Println("usage: pulldeploy enable -app=<app> -version=<version>")
 	case "disable":
@@ -91,17 +115,33 @@ func showCommandHelp(command string) bool {
 	case "purge":
 		fmt.Println("usage: pulldeploy purge -app=<app> -version=<version>")
 	case "deploy":
-		fmt.Println("usage: pulldeploy deploy -app=<app> -version=<version> -env=<env>")
+		fmt.Println("usage: pulldeploy deploy -app=<app> -version=<version> -env=<env> [-force]")
 	case "release":
-		fmt.Println("usage: pulldeploy release -app=<app> -version=<version> -env=<env> [host1, host2, ...]")
+		fmt.Println("usage: pulldeploy release -app=<app> -version=<version> -env=<env> [-force] [host1, host2, ...]")
+	case "lock":
+		fmt.Println("usage: pulldeploy lock -app=<app> -env=<env> -reason=<reason> [-schedule=<cron> -duration=<duration>]")
+	case "unlock":
+		fmt.Println("usage: pulldeploy unlock -app=<app> -env=<env> [-schedule=<cron>]")
+	case "request-release":
+		fmt.Println("usage: pulldeploy request-release -app=<app> -version=<version> -env=<env> [host1, host2, ...]")
+	case "approve":
+		fmt.Println("usage: pulldeploy approve -app=<app> -version=<version> -env=<env>")
+	case "reject":
+		fmt.Println("usage: pulldeploy reject -app=<app> -version=<version> -env=<env> [-reason=<reason>]")
 	case "list":
 		fmt.Println("usage: pulldeploy list")
 	case "status":
 		fmt.Println("usage: pulldeploy status -app=<app>")
 	case "listhosts":
 		fmt.Println("usage: pulldeploy listhosts -app=<app> -env=<env>")
+	case "repo":
+		fmt.Println("usage: pulldeploy repo ls [-app=<app>]")
+	case "fsck":
+		fmt.Println("usage: pulldeploy fsck -app=<app> [-repair]")
+	case "mirror":
+		fmt.Println("usage: pulldeploy mirror -to=<accessmethod> [-from=<accessmethod>] [-app=<app>] [-prune] [-watch [-interval=<duration>]]")
 	case "daemon":
-		fmt.Println("usage: pulldeploy daemon -env=<env> [-logfile=<logfilename>]")
+		fmt.Println("usage: pulldeploy daemon [-env=<env>] [-logfile=<logfilename>] [-pidfile=<pidfilename>]")
 	default:
 		fmt.Printf("invalid command: %q\n", command)
 		isValid = false
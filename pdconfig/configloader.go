@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -22,10 +24,15 @@ type pdConfig struct {
 	configDir     string                // Invisible to YAML decoder, determined at runtime
 	configFile    string                // Invisible to YAML decoder, determined at runtime
 	appList       map[string]*AppConfig // Invisible to YAML decoder, loaded separately
+	skippedFiles  []string              // Invisible to YAML decoder, noted while loading the apps
 	LogLevel      string                // The level at which to log: debug|info|warn|error
 	AccessMethod  string                // One of the KST_* AccessMethod constants
 	Storage       map[string]map[string]string
 	Signaller     SignallerConfig
+	Cache         CacheConfig
+	Peers         PeerConfig
+	Disk          DiskConfig
+	Environments  map[string]string // The environment monitored for each application, by name
 	ArtifactTypes map[string]ArtifactConfig
 }
 
@@ -90,6 +97,21 @@ func isInsecure(filepath string) bool {
 	return isInsecure
 }
 
+// A token that may be a substitution variable.
+var varPattern = regexp.MustCompile("#[A-Z][A-Z_]*#")
+
+// checkVars ensures that a command and its arguments use only known substitution variables.
+func checkVars(command sysCommand) error {
+	for _, s := range append([]string{command.Cmd}, command.Args...) {
+		for _, token := range varPattern.FindAllString(s, -1) {
+			if _, known := SubstitutionVars[token]; !known {
+				return fmt.Errorf("unknown variable %s in %q", token, s)
+			}
+		}
+	}
+	return nil
+}
+
 // loadAppConfig loads the configuration for a client application.
 func loadAppConfig(configDir, appName string) (*AppConfig, error) {
 
@@ -106,33 +128,109 @@ func loadAppConfig(configDir, appName string) (*AppConfig, error) {
 		return nil, err
 	}
 
+	// Scripts may run only at known phases.
+	for phase, script := range appcfg.Scripts {
+		known := false
+		for _, p := range hookPhases {
+			known = known || p == phase
+		}
+		if !known {
+			return nil, fmt.Errorf("Application %q has a script for unknown phase %q", appName, phase)
+		}
+		if script.Timeout < 0 {
+			return nil, fmt.Errorf("Application %q has a negative timeout for its %s script", appName, phase)
+		}
+		if err := checkVars(script); err != nil {
+			return nil, fmt.Errorf("Application %q %s script error: %s", appName, phase, err.Error())
+		}
+	}
+
+	// Templates and shared directories must lie within the release directory.
+	for _, tmpl := range appcfg.Templates {
+		if !isWithinDir(tmpl) {
+			return nil, fmt.Errorf("Application %q template %q is not within the release directory", appName, tmpl)
+		}
+	}
+	for _, shared := range appcfg.Shared {
+		if !isWithinDir(shared) {
+			return nil, fmt.Errorf("Application %q shared path %q is not within the release directory", appName, shared)
+		}
+	}
+
+	if appcfg.DiskExpansion < 0 {
+		return nil, fmt.Errorf("Application %q has a negative disk expansion", appName)
+	}
+
 	// When running as root, configurations must be secure.
 	appcfg.Insecure = isInsecure(appcfgfile)
 
 	return appcfg, nil
 }
 
+// isWithinDir indicates whether a relative path names something within a directory.
+func isWithinDir(relPath string) bool {
+	clean := path.Clean(relPath)
+	return !path.IsAbs(clean) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// loadAppEnvVars loads the template values for a client application in an environment.
+func loadAppEnvVars(configDir, appName, envName string) (map[string]interface{}, error) {
+
+	vars := make(map[string]interface{})
+	varsfile := path.Join(configDir, kCONFIG_APP_DIR, appName+"."+envName+kCONFIG_APP_EXT)
+
+	// Read in the YAML and decode it.
+	text, err := ioutil.ReadFile(varsfile)
+	if err == nil {
+		if err = yaml.Unmarshal(text, &vars); err != nil {
+			return nil, fmt.Errorf("Unable to decode %q: %s", varsfile, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return vars, nil
+}
+
 // loadAppList reads in the definitions of all the configured applications.
-func loadAppList(configDir string) (map[string]*AppConfig, []error) {
+// A file named <app>.<env>.yaml, where <app> is an application that was loaded,
+// holds the template values for an environment rather than an application; each
+// such file is noted in the list of skipped files returned.
+func loadAppList(configDir string) (map[string]*AppConfig, []string, []error) {
 
 	var errs []error = make([]error, 0)
+	var skipped []string
 	var appList = make(map[string]*AppConfig)
 
 	if files, err := ioutil.ReadDir(path.Join(configDir, kCONFIG_APP_DIR)); err == nil {
+
+		// Shorter names first, so that an application is loaded before its environments.
+		var names []string
 		for _, file := range files {
-			filename := file.Name()
-			if path.Ext(filename) == kCONFIG_APP_EXT {
-				appName := strings.TrimSuffix(filename, kCONFIG_APP_EXT)
-				if ac, err := loadAppConfig(configDir, appName); err == nil {
-					appList[appName] = ac
-				} else {
-					errs = append(errs, err)
+			if filename := file.Name(); path.Ext(filename) == kCONFIG_APP_EXT {
+				names = append(names, strings.TrimSuffix(filename, kCONFIG_APP_EXT))
+			}
+		}
+		sort.SliceStable(names, func(i, j int) bool { return len(names[i]) < len(names[j]) })
+
+		for _, appName := range names {
+			if i := strings.LastIndex(appName, "."); i > 0 {
+				if _, found := appList[appName[:i]]; found {
+					skipped = append(skipped, fmt.Sprintf(
+						"%q holds the %q template values for application %q; not loaded as an application",
+						appName+kCONFIG_APP_EXT, appName[i+1:], appName[:i]))
+					continue
 				}
 			}
+			if ac, err := loadAppConfig(configDir, appName); err == nil {
+				appList[appName] = ac
+			} else {
+				errs = append(errs, err)
+			}
 		}
 	}
 
-	return appList, errs
+	return appList, skipped, errs
 }
 
 // LoadPulldeployConfig loads the main configuration file and all the client apps.
@@ -171,7 +269,13 @@ func LoadPulldeployConfig(configDir string) (PDConfig, []error) {
 	// Validate the system-specific shell commands.
 	var allOK = true
 	for atype, acfg := range pdcfg.ArtifactTypes {
-		if acfg.Extract.Cmd != "" {
+		if err := checkVars(acfg.Extract); err != nil {
+			errs = append(errs, fmt.Errorf(
+				"ArtifactType %q extract command error: %s",
+				atype, err.Error()))
+			allOK = false
+		}
+		if acfg.Extract.Cmd != "" && !strings.Contains(acfg.Extract.Cmd, "#") {
 			if _, err := os.Stat(acfg.Extract.Cmd); os.IsNotExist(err) {
 				errs = append(errs, fmt.Errorf(
 					"ArtifactType %q extract command error: %s",
@@ -189,8 +293,9 @@ func LoadPulldeployConfig(configDir string) (PDConfig, []error) {
 	}
 
 	// Read in all the client application definitions.
-	if appList, appErrs := loadAppList(pdcfg.configDir); len(appErrs) == 0 {
+	if appList, skipped, appErrs := loadAppList(pdcfg.configDir); len(appErrs) == 0 {
 		pdcfg.appList = appList
+		pdcfg.skippedFiles = skipped
 	} else {
 		pdcfg.appList = make(map[string]*AppConfig)
 		errs = append(errs, appErrs...)
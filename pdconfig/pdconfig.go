@@ -16,6 +16,8 @@ type SignallerConfig struct {
 	PollInterval int             // Seconds between repository polls when not using Zookeeper
 	PollFallback int             // Seconds between repository polls when Zookeeper is available
 	ZK           ZookeeperConfig `yaml:"zookeeper"`
+	FetchJitter  int             // Maximum seconds of random delay before fetching new artifacts
+	MaxFetchRate int             // Maximum KB per second for fetching artifacts from storage; 0 for no limit
 }
 
 // StorageConfig contains the repository storage location, and its instantiation parameters.
@@ -24,11 +26,62 @@ type StorageConfig struct {
 	Params       map[string]string // Type-specific parameters
 }
 
+// CacheConfig locates the cache of verified artifacts on application hosts.
+type CacheConfig struct {
+	Dir     string // The cache directory; no cache is used if empty
+	MaxSize int64  // The size in MB beyond which the least recently used artifacts are evicted
+}
+
+// PeerConfig controls the sharing of verified artifacts between the daemons in an environment.
+type PeerConfig struct {
+	Listen    string // The address on which to serve artifacts to peers, such as ":8765"; no sharing if empty
+	Advertise string // The URL at which peers reach this host; default "http://<hostname>:<port>"
+	Token     string // An optional secret that peers must present
+	MaxPeers  int    // How many peers to try before falling back to the repository; default 3
+}
+
+// DiskConfig controls the check for free space on application hosts before deploying a version.
+type DiskConfig struct {
+	Expansion float64 // The free space needed to fetch and extract an artifact, as a multiple of its size; default 3
+	Reserve   int64   // The space in MB to leave free besides; default 0
+	Prune     bool    // Whether to remove versions no longer deployed to the environment first, when space is short
+}
+
 type sysCommand struct {
-	Cmd  string
-	Args []string
+	Cmd     string
+	Args    []string
+	Timeout int // Seconds after which a script is killed; 0 for the default
+}
+
+// The phases of a deployment at which an application's scripts may run.
+const (
+	KHOOK_PREDEPLOY    = "predeploy"    // Before a new version is extracted; failure abandons the deployment
+	KHOOK_POSTDEPLOY   = "postdeploy"   // After a new version is extracted
+	KHOOK_PRERELEASE   = "prerelease"   // Before the current release is changed; failure leaves it unchanged
+	KHOOK_POSTRELEASE  = "postrelease"  // After the current release is changed to a newer version
+	KHOOK_POSTROLLBACK = "postrollback" // After the current release is changed back to an older version
+	KHOOK_PREREMOVE    = "preremove"    // Before a version no longer deployed is removed; failure keeps it
+	KHOOK_ONFAILURE    = "onfailure"    // After any deployment or release step fails
+)
+
+// SubstitutionVars are the variables that may appear anywhere in the commands run
+// during deployment, and in their arguments, along with the values replacing them.
+var SubstitutionVars = map[string]string{
+	"#APPNAME#":      "The name of the application",
+	"#ENV#":          "The environment being tracked",
+	"#VERSION#":      "The version being deployed, released or removed",
+	"#PRIORVERSION#": "The version that was current before this step",
+	"#HOSTNAME#":     "The name of the local host",
+	"#BASEDIR#":      "The directory holding all the application's files, BASEDIR/APPNAME",
+	"#CURRENTDIR#":   "The \"current\" symlink to the released version",
+	"#ARTIFACTPATH#": "The artifact of the version",
+	"#VERSIONDIR#":   "The release directory of the version",
 }
 
+// The phases at which scripts may run, for validating configurations.
+var hookPhases = []string{KHOOK_PREDEPLOY, KHOOK_POSTDEPLOY, KHOOK_PRERELEASE, KHOOK_POSTRELEASE,
+	KHOOK_POSTROLLBACK, KHOOK_PREREMOVE, KHOOK_ONFAILURE}
+
 // ArtifactConfig defines the valid artifact types and how to unpack them.
 type ArtifactConfig struct {
 	Insecure  bool       // True if configuration was loaded from insecure file
@@ -47,6 +100,27 @@ type AppConfig struct {
 	Group        string // The group that should own all deployed artifacts
 	Insecure     bool   // True if configuration was loaded from insecure file
 	Scripts      map[string]sysCommand
+	FetchJitter  int // Overrides the signaller FetchJitter for this application if non-zero; -1 for none
+
+	// The environment monitored for this application by the daemon on this host,
+	// overriding pulldeploy.yaml and the daemon's -env.
+	Environment string
+
+	// Files within the artifact, relative to the release directory, that are rendered
+	// in place with text/template after extraction, using the values for the environment.
+	Templates []string
+
+	// Directories within the release directory, such as "log", that are instead links
+	// to directories under BASEDIR/APPNAME/shared, which persist from one release to the next.
+	Shared []string
+
+	// Overrides the disk Expansion for this application if non-zero, for artifacts
+	// that expand more or less than most when extracted.
+	DiskExpansion float64
+
+	// The master key for encrypting artifacts at rest; at most one may be given.
+	EncryptionKey     string // A base64-encoded 256-bit key
+	EncryptionKeyFile string // A file containing a base64-encoded 256-bit key
 }
 
 // The definition of the configuration object shared throughout PullDeploy.
@@ -55,9 +129,16 @@ type PDConfig interface {
 	GetVersionInfo() *VersionInfo
 	GetSignallerConfig() *SignallerConfig
 	GetStorageConfig() *StorageConfig
+	GetStorageConfigByMethod(accessMethod string) (*StorageConfig, error)
+	GetCacheConfig() *CacheConfig
+	GetPeerConfig() *PeerConfig
+	GetDiskConfig() *DiskConfig
 	GetArtifactConfig(artifactType string) (*ArtifactConfig, error)
 	GetAppConfig(appName string) (*AppConfig, error)
 	GetAppList() map[string]*AppConfig
+	GetSkippedFiles() []string
+	GetAppEnvVars(appName, envName string) (map[string]interface{}, error)
+	GetAppEnv(appName string) string
 	RefreshAppList() []error
 }
 
@@ -77,6 +158,8 @@ func (pdcfg *pdConfig) GetSignallerConfig() *SignallerConfig {
 	sc.PollInterval = pdcfg.Signaller.PollInterval
 	sc.PollFallback = pdcfg.Signaller.PollFallback
 	sc.ZK = pdcfg.Signaller.ZK
+	sc.FetchJitter = pdcfg.Signaller.FetchJitter
+	sc.MaxFetchRate = pdcfg.Signaller.MaxFetchRate
 	return sc
 }
 
@@ -92,6 +175,49 @@ func (pdcfg *pdConfig) GetStorageConfig() *StorageConfig {
 	return sc
 }
 
+// GetStorageConfigByMethod returns the params for a storage access method
+// other than the configured one, for example to mirror between them.
+func (pdcfg *pdConfig) GetStorageConfigByMethod(accessMethod string) (*StorageConfig, error) {
+	if params, found := pdcfg.Storage[accessMethod]; found {
+		sc := new(StorageConfig)
+		sc.AccessMethod = accessMethod
+		sc.Params = params
+		return sc, nil
+	} else {
+		return nil, fmt.Errorf("No configuration for storage access method %q", accessMethod)
+	}
+}
+
+// GetCacheConfig returns the location and size of the artifact cache.
+func (pdcfg *pdConfig) GetCacheConfig() *CacheConfig {
+	cc := new(CacheConfig)
+	*cc = pdcfg.Cache
+	return cc
+}
+
+// GetPeerConfig returns the settings for sharing artifacts between daemons.
+func (pdcfg *pdConfig) GetPeerConfig() *PeerConfig {
+	pc := new(PeerConfig)
+	*pc = pdcfg.Peers
+	if pc.MaxPeers <= 0 {
+		pc.MaxPeers = 3
+	}
+	return pc
+}
+
+// GetDiskConfig returns the settings for checking free space before deploying.
+func (pdcfg *pdConfig) GetDiskConfig() *DiskConfig {
+	dc := new(DiskConfig)
+	*dc = pdcfg.Disk
+	if dc.Expansion <= 0 {
+		dc.Expansion = 3
+	}
+	if dc.Reserve < 0 {
+		dc.Reserve = 0
+	}
+	return dc
+}
+
 // GetArtifactConfig returns a client application configuration.
 func (pdcfg *pdConfig) GetArtifactConfig(artifactType string) (*ArtifactConfig, error) {
 
@@ -133,11 +259,35 @@ func (pdcfg *pdConfig) GetAppList() map[string]*AppConfig {
 	return appList
 }
 
+// GetSkippedFiles describes the files in the application configuration directory
+// that were not loaded as applications.
+func (pdcfg *pdConfig) GetSkippedFiles() []string {
+	return append([]string(nil), pdcfg.skippedFiles...)
+}
+
+// GetAppEnvVars returns the values for rendering the templates of a client
+// application in an environment, loaded from /etc/pulldeploy.d/<appname>.<envname>.yaml;
+// there are none if the file does not exist.
+func (pdcfg *pdConfig) GetAppEnvVars(appName, envName string) (map[string]interface{}, error) {
+	return loadAppEnvVars(pdcfg.configDir, appName, envName)
+}
+
+// GetAppEnv returns the environment that the daemon monitors for a client
+// application, if one is configured for it; the application's own configuration
+// takes precedence over the Environments of pulldeploy.yaml.
+func (pdcfg *pdConfig) GetAppEnv(appName string) string {
+	if ac, found := pdcfg.appList[appName]; found && ac.Environment != "" {
+		return ac.Environment
+	}
+	return pdcfg.Environments[appName]
+}
+
 // RefreshAppList re-reads the definitions of all the configured applications.
 func (pdcfg *pdConfig) RefreshAppList() []error {
 	var errs []error = make([]error, 0)
-	if appList, appErrs := loadAppList(pdcfg.configDir); appErrs == nil {
+	if appList, skipped, appErrs := loadAppList(pdcfg.configDir); len(appErrs) == 0 {
 		pdcfg.appList = appList
+		pdcfg.skippedFiles = skipped
 	} else {
 		errs = appErrs
 	}
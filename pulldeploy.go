@@ -64,12 +64,28 @@ func main() {
 		cmd = new(command.Deploy)
 	case "release":
 		cmd = new(command.Release)
+	case "lock":
+		cmd = new(command.Lock)
+	case "unlock":
+		cmd = new(command.Unlock)
+	case "request-release":
+		cmd = new(command.Requestrelease)
+	case "approve":
+		cmd = new(command.Approve)
+	case "reject":
+		cmd = new(command.Reject)
 	case "list":
 		cmd = new(command.List)
 	case "status":
 		cmd = new(command.Status)
 	case "listhosts":
 		cmd = new(command.Listhosts)
+	case "repo":
+		cmd = new(command.Repo)
+	case "fsck":
+		cmd = new(command.Fsck)
+	case "mirror":
+		cmd = new(command.Mirror)
 	case "daemon":
 		cmd = new(command.Daemon)
 	default:
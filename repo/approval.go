@@ -0,0 +1,225 @@
+package repo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const kMAX_APR_HST_ENTRIES = 20
+const kDEFAULT_APPROVAL_TTL = "24h"
+
+// The actions recorded in the approval history.
+const (
+	KAPR_REQUESTED = "requested"
+	KAPR_APPROVED  = "approved"
+	KAPR_REJECTED  = "rejected"
+	KAPR_EXPIRED   = "expired"
+	KAPR_RELEASED  = "released"
+)
+
+// ReleaseRequest is a request to release a version, pending approval by other users.
+type ReleaseRequest struct {
+	Version    string    `json:"version"`    // The version to be released
+	Previewers []string  `json:"previewers"` // The hosts named for a preview release, if any
+	Requester  string    `json:"requester"`  // The user who requested the release
+	Approvers  []string  `json:"approvers"`  // The users who have approved the release
+	TS         time.Time `json:"timestamp"`  // The time at which the release was requested
+}
+
+// ApprovalEvent records activity on release requests.
+type ApprovalEvent struct {
+	Version string    `json:"version"`           // The version affected
+	Action  string    `json:"action"`            // One of the KAPR_* actions
+	User    string    `json:"user"`              // The user who took the action
+	Comment string    `json:"comment,omitempty"` // An optional explanation, such as a rejection reason
+	TS      time.Time `json:"timestamp"`         // The time at which the event occurred
+}
+
+// SetApprovalsRequired sets the number of approvals needed before a release may proceed.
+func (env *Env) SetApprovalsRequired(count int) error {
+	if count < 0 {
+		return fmt.Errorf("approval count may not be negative")
+	}
+	env.ApprovalsRequired = count
+	return nil
+}
+
+// SetApprovalTTL sets how long a release request remains valid.
+func (env *Env) SetApprovalTTL(ttl string) error {
+	if dur, err := time.ParseDuration(ttl); err != nil || dur <= 0 {
+		return fmt.Errorf("invalid approval TTL %q", ttl)
+	}
+	env.ApprovalTTL = ttl
+	return nil
+}
+
+// RequestRelease creates a pending request to release a version.
+func (env *Env) RequestRelease(versionName string, previewers []string, requester string) error {
+
+	env.expireRequests(time.Now())
+
+	// Only one request per version may be pending.
+	if req := env.findRequest(versionName); req != nil {
+		return fmt.Errorf("release of version %q already requested by %q", versionName, req.Requester)
+	}
+
+	// The version must be releasable.
+	if err := env.checkReleasable(versionName); err != nil {
+		return err
+	}
+
+	env.Requests = append(env.Requests, ReleaseRequest{
+		versionName, previewers, requester, []string{}, time.Now()})
+	env.recordApproval(versionName, KAPR_REQUESTED, requester, "")
+
+	return nil
+}
+
+// Approve adds the approval of the given user to a pending release request.
+func (env *Env) Approve(versionName, approver string) error {
+
+	env.expireRequests(time.Now())
+
+	req := env.findRequest(versionName)
+	if req == nil {
+		return fmt.Errorf("no pending release request for version %q", versionName)
+	}
+	if approver == req.Requester {
+		return fmt.Errorf("release of version %q may not be approved by its requester %q", versionName, approver)
+	}
+	for _, s := range req.Approvers {
+		if s == approver {
+			return fmt.Errorf("release of version %q already approved by %q", versionName, approver)
+		}
+	}
+
+	req.Approvers = append(req.Approvers, approver)
+	env.recordApproval(versionName, KAPR_APPROVED, approver, "")
+
+	return nil
+}
+
+// Reject cancels a pending release request.
+func (env *Env) Reject(versionName, rejecter, reason string) error {
+
+	env.expireRequests(time.Now())
+
+	req := env.findRequest(versionName)
+	if req == nil {
+		return fmt.Errorf("no pending release request for version %q", versionName)
+	}
+	if rejecter == req.Requester {
+		return fmt.Errorf("release of version %q may not be rejected by its requester %q", versionName, rejecter)
+	}
+
+	env.removeRequest(versionName)
+	env.recordApproval(versionName, KAPR_REJECTED, rejecter, reason)
+
+	return nil
+}
+
+// checkApproved ensures that a release has been approved by enough users,
+// when the environment requires it.
+func (env *Env) checkApproved(versionName string, previewers []string) error {
+
+	if env.ApprovalsRequired == 0 {
+		return nil
+	}
+
+	env.expireRequests(time.Now())
+
+	req := env.findRequest(versionName)
+	if req == nil {
+		return fmt.Errorf("release of version %q requires %d approval(s); use request-release",
+			versionName, env.ApprovalsRequired)
+	}
+	if len(req.Approvers) < env.ApprovalsRequired {
+		return fmt.Errorf("release of version %q has %d of %d required approval(s)",
+			versionName, len(req.Approvers), env.ApprovalsRequired)
+	}
+	if !sameHosts(req.Previewers, previewers) {
+		return fmt.Errorf("release of version %q was approved for hosts [%s], not [%s]",
+			versionName, strings.Join(req.Previewers, ", "), strings.Join(previewers, ", "))
+	}
+
+	return nil
+}
+
+// consumeApproval removes the request once the release has been made.
+func (env *Env) consumeApproval(versionName, releaser string) {
+	if env.findRequest(versionName) != nil {
+		env.removeRequest(versionName)
+		env.recordApproval(versionName, KAPR_RELEASED, releaser, "")
+	}
+}
+
+func (env *Env) approvalTTL() time.Duration {
+	ttl := env.ApprovalTTL
+	if ttl == "" {
+		ttl = kDEFAULT_APPROVAL_TTL
+	}
+	dur, err := time.ParseDuration(ttl)
+	if err != nil {
+		dur, _ = time.ParseDuration(kDEFAULT_APPROVAL_TTL)
+	}
+	return dur
+}
+
+func (env *Env) expireRequests(now time.Time) {
+	ttl := env.approvalTTL()
+	requests := make([]ReleaseRequest, 0)
+	for _, req := range env.Requests {
+		if now.Sub(req.TS) < ttl {
+			requests = append(requests, req)
+		} else {
+			env.recordApproval(req.Version, KAPR_EXPIRED, req.Requester, "")
+		}
+	}
+	env.Requests = requests
+}
+
+func (env *Env) findRequest(versionName string) *ReleaseRequest {
+	for i := range env.Requests {
+		if env.Requests[i].Version == versionName {
+			return &env.Requests[i]
+		}
+	}
+	return nil
+}
+
+func (env *Env) removeRequest(versionName string) {
+	requests := make([]ReleaseRequest, 0)
+	for _, req := range env.Requests {
+		if req.Version != versionName {
+			requests = append(requests, req)
+		}
+	}
+	env.Requests = requests
+}
+
+func (env *Env) recordApproval(versionName, action, user, comment string) {
+	env.Approvals = append([]ApprovalEvent{ApprovalEvent{versionName, action, user, comment, time.Now()}},
+		env.Approvals...)
+	if len(env.Approvals) > kMAX_APR_HST_ENTRIES {
+		env.Approvals = env.Approvals[:kMAX_APR_HST_ENTRIES]
+	}
+}
+
+// Utility helper to compare two host lists, ignoring order.
+func sameHosts(hosts1, hosts2 []string) bool {
+	if len(hosts1) != len(hosts2) {
+		return false
+	}
+	h1 := append([]string{}, hosts1...)
+	h2 := append([]string{}, hosts2...)
+	sort.Strings(h1)
+	sort.Strings(h2)
+	for i := range h1 {
+		if h1[i] != h2[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -15,14 +15,29 @@ type HistEvent struct {
 
 // Env enumerates the versions deployed to an environment, and identifies the current release.
 type Env struct {
-	Keep       int         `json:"keep"`       // The maximum number of versions to retain when adding
-	Prior      string      `json:"prior"`      // The version most recently active prior to current
-	Current    string      `json:"current"`    // The currently active version
-	Preview    string      `json:"preview"`    // The version considered active by the Previewers hosts
-	Deployed   []HistEvent `json:"deployed"`   // The set of versions deployed to this environment
-	Released   []HistEvent `json:"released"`   // The set of versions released to this environment
-	Previewers []string    `json:"previewers"` // The set of hostnames eligible for the Preview version
-	versions   map[string]*Version
+	Keep       int            `json:"keep"`              // The maximum number of versions to retain when adding
+	Prior      string         `json:"prior"`             // The version most recently active prior to current
+	Current    string         `json:"current"`           // The currently active version
+	Preview    string         `json:"preview"`           // The version considered active by the Previewers hosts
+	Deployed   []HistEvent    `json:"deployed"`          // The set of versions deployed to this environment
+	Released   []HistEvent    `json:"released"`          // The set of versions released to this environment
+	Previewers []string       `json:"previewers"`        // The set of hostnames eligible for the Preview version
+	Lock       *EnvLock       `json:"lock,omitempty"`    // Set while the environment is locked against changes
+	Freezes    []FreezeWindow `json:"freezes,omitempty"` // Recurring windows during which the environment is locked
+
+	ApprovalsRequired int              `json:"approvalsrequired"`     // Approvals needed before a release; 0 for none
+	ApprovalTTL       string           `json:"approvalttl,omitempty"` // How long a release request remains valid
+	Requests          []ReleaseRequest `json:"requests,omitempty"`    // Release requests awaiting approval
+	Approvals         []ApprovalEvent  `json:"approvals,omitempty"`   // The history of release request activity
+
+	versions map[string]*Version
+}
+
+// EnvLock records who locked an environment, and why.
+type EnvLock struct {
+	Holder string    `json:"holder"`    // The user who placed the lock
+	Reason string    `json:"reason"`    // Why the environment is locked
+	TS     time.Time `json:"timestamp"` // The time at which the lock was placed
 }
 
 func newEnv() *Env {
@@ -34,8 +49,76 @@ func (env *Env) SetKeep(keep int) {
 	env.Keep = keep
 }
 
+// SetLock locks the environment against deploys and releases.
+func (env *Env) SetLock(holder, reason string) error {
+	if env.Lock != nil {
+		return fmt.Errorf("already locked by %q: %s", env.Lock.Holder, env.Lock.Reason)
+	}
+	env.Lock = &EnvLock{holder, reason, time.Now()}
+	return nil
+}
+
+// ClearLock removes the lock placed by SetLock.
+func (env *Env) ClearLock() error {
+	if env.Lock == nil {
+		return fmt.Errorf("not locked")
+	}
+	env.Lock = nil
+	return nil
+}
+
+// AddFreeze adds a recurring window during which the environment is locked.
+func (env *Env) AddFreeze(schedule, duration, holder, reason string) error {
+	for _, fw := range env.Freezes {
+		if fw.Schedule == schedule {
+			return fmt.Errorf("freeze schedule %q already present", schedule)
+		}
+	}
+	fw, err := newFreezeWindow(schedule, duration, holder, reason)
+	if err != nil {
+		return err
+	}
+	env.Freezes = append(env.Freezes, *fw)
+	return nil
+}
+
+// RmFreeze removes the recurring window with the given schedule.
+func (env *Env) RmFreeze(schedule string) error {
+	for i, fw := range env.Freezes {
+		if fw.Schedule == schedule {
+			env.Freezes = append(env.Freezes[:i], env.Freezes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("freeze schedule %q not present", schedule)
+}
+
+// CheckLock returns an error naming the holder and reason if the environment
+// is locked, or within a freeze window, at the given time.
+func (env *Env) CheckLock(t time.Time) error {
+	if env.Lock != nil {
+		return fmt.Errorf("environment locked by %q since %s: %s",
+			env.Lock.Holder, env.Lock.TS.Format(time.RFC1123), env.Lock.Reason)
+	}
+	for _, fw := range env.Freezes {
+		if fw.ActiveAt(t) {
+			return fmt.Errorf("environment frozen by %q (schedule %q for %s): %s",
+				fw.Holder, fw.Schedule, fw.Duration, fw.Reason)
+		}
+	}
+	return nil
+}
+
 // Deploy makes an uploaded artifact available in this environment.
-func (env *Env) Deploy(versionName string) error {
+// It is refused while the environment is locked, unless force is set.
+func (env *Env) Deploy(versionName string, force bool) error {
+
+	// Respect any lock on the environment.
+	if !force {
+		if err := env.CheckLock(time.Now()); err != nil {
+			return err
+		}
+	}
 
 	// Ensure that this version of the artifact is not already deployed.
 	for _, v := range env.Deployed {
@@ -81,7 +164,42 @@ func (env *Env) Deploy(versionName string) error {
 }
 
 // Release makes a deployed artifact the currently active one in this environment.
-func (env *Env) Release(versionName string, previewers []string) error {
+// It is refused while the environment is locked, unless force is set, and when
+// the environment requires approvals, until the release has been approved.
+func (env *Env) Release(versionName string, previewers []string, releaser string, force bool) error {
+
+	// Respect any lock on the environment.
+	if !force {
+		if err := env.CheckLock(time.Now()); err != nil {
+			return err
+		}
+	}
+
+	// Ensure that this version is eligible for release.
+	if err := env.checkReleasable(versionName); err != nil {
+		return err
+	}
+
+	// Ensure that the release has been approved, if necessary.
+	if err := env.checkApproved(versionName, previewers); err != nil {
+		return err
+	}
+
+	// Mark it as having been released, and close out its approval.
+	env.versions[versionName].Release()
+	env.consumeApproval(versionName, releaser)
+
+	// If specific hosts have been named, only they get the release as a preview.
+	if len(previewers) > 0 {
+		return env.releasePreview(versionName, previewers)
+	}
+
+	// The release is general, and goes out to every host.
+	return env.releaseGeneral(versionName)
+}
+
+// checkReleasable ensures that a version has been deployed, and is enabled.
+func (env *Env) checkReleasable(versionName string) error {
 
 	// Ensure that this version of the artifact has been deployed.
 	found := false
@@ -100,20 +218,12 @@ func (env *Env) Release(versionName string, previewers []string) error {
 		if !vers.Enabled {
 			return fmt.Errorf("version %q has been disabled", versionName)
 		}
-		// Mark it as having been released.
-		vers.Release()
 	} else {
 		// This shouldn't happen, but just in case...
 		return fmt.Errorf("version %q not found in environment", versionName)
 	}
 
-	// If specific hosts have been named, only they get the release as a preview.
-	if len(previewers) > 0 {
-		return env.releasePreview(versionName, previewers)
-	}
-
-	// The release is general, and goes out to every host.
-	return env.releaseGeneral(versionName)
+	return nil
 }
 
 // GetCurrentVersion returns the current version for the specified host.
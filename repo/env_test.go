@@ -0,0 +1,200 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEnvLock(t *testing.T) {
+
+	envName := "production"
+	ri := NewIndex("Example_App")
+	ri.AddEnv(envName)
+	ri.AddVersion("1.0.1", "foo.tar.gz", true, func(string) {})
+	ri.AddVersion("1.0.2", "foo.tar.gz", true, func(string) {})
+	env, _ := ri.GetEnv(envName)
+
+	// Clearing a lock that is not set should fail.
+	if err := env.ClearLock(); err == nil {
+		t.Errorf("Env ClearLock should have failed when not locked")
+	}
+
+	// Lock the environment; a second lock should fail.
+	if err := env.SetLock("alice", "incident 42"); err != nil {
+		t.Errorf("Env SetLock failed: %s", err.Error())
+	}
+	if err := env.SetLock("bob", "holiday"); err == nil {
+		t.Errorf("Env SetLock should have failed when already locked")
+	}
+
+	// Deploy should be refused, and name the holder and reason.
+	if err := env.Deploy("1.0.1", false); err == nil {
+		t.Errorf("Env Deploy should have failed while locked")
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	// Forcing should override the lock.
+	if err := env.Deploy("1.0.1", true); err != nil {
+		t.Errorf("Env Deploy with force failed: %s", err.Error())
+	}
+	if err := env.Release("1.0.1", []string{}, "alice", false); err == nil {
+		t.Errorf("Env Release should have failed while locked")
+	}
+	if err := env.Release("1.0.1", []string{}, "alice", true); err != nil {
+		t.Errorf("Env Release with force failed: %s", err.Error())
+	}
+
+	// Once unlocked, no force is needed.
+	if err := env.ClearLock(); err != nil {
+		t.Errorf("Env ClearLock failed: %s", err.Error())
+	}
+	if err := env.Deploy("1.0.2", false); err != nil {
+		t.Errorf("Env Deploy failed after unlock: %s", err.Error())
+	}
+}
+
+func TestEnvFreeze(t *testing.T) {
+
+	env := newEnv()
+
+	// Invalid schedules and durations should be rejected.
+	for _, sched := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *"} {
+		if err := env.AddFreeze(sched, "1h", "alice", "bad"); err == nil {
+			t.Errorf("Env AddFreeze should have failed for schedule %q", sched)
+		}
+	}
+	for _, dur := range []string{"", "30s", "1000h", "soon"} {
+		if err := env.AddFreeze("0 17 * * 5", dur, "alice", "bad"); err == nil {
+			t.Errorf("Env AddFreeze should have failed for duration %q", dur)
+		}
+	}
+
+	// Freeze from Friday 17:00 for the weekend.
+	if err := env.AddFreeze("0 17 * * 5", "63h", "alice", "weekend"); err != nil {
+		t.Errorf("Env AddFreeze failed: %s", err.Error())
+	}
+	if err := env.AddFreeze("0 17 * * 5", "63h", "alice", "weekend"); err == nil {
+		t.Errorf("Env AddFreeze should have failed as duplicate")
+	}
+
+	// 2016-06-03 is a Friday.
+	checks := []struct {
+		ts     time.Time
+		locked bool
+	}{
+		{time.Date(2016, 6, 3, 16, 59, 0, 0, time.Local), false},
+		{time.Date(2016, 6, 3, 17, 0, 0, 0, time.Local), true},
+		{time.Date(2016, 6, 5, 12, 0, 0, 0, time.Local), true},
+		{time.Date(2016, 6, 6, 7, 59, 0, 0, time.Local), true},
+		{time.Date(2016, 6, 6, 8, 0, 0, 0, time.Local), false},
+		{time.Date(2016, 6, 8, 12, 0, 0, 0, time.Local), false},
+	}
+	for _, check := range checks {
+		if err := env.CheckLock(check.ts); (err != nil) != check.locked {
+			t.Errorf("Env CheckLock at %s: expected locked=%v, got %v", check.ts, check.locked, err)
+		}
+	}
+
+	// Remove the window.
+	if err := env.RmFreeze("0 17 * * 5"); err != nil {
+		t.Errorf("Env RmFreeze failed: %s", err.Error())
+	}
+	if err := env.RmFreeze("0 17 * * 5"); err == nil {
+		t.Errorf("Env RmFreeze should have failed when not present")
+	}
+	if err := env.CheckLock(time.Date(2016, 6, 5, 12, 0, 0, 0, time.Local)); err != nil {
+		t.Errorf("Env CheckLock should have succeeded after RmFreeze: %s", err.Error())
+	}
+}
+
+func TestEnvApprovals(t *testing.T) {
+
+	envName := "production"
+	ri := NewIndex("Example_App")
+	ri.AddEnv(envName)
+	ri.AddVersion("1.0.1", "foo.tar.gz", true, func(string) {})
+	env, _ := ri.GetEnv(envName)
+	env.Deploy("1.0.1", false)
+
+	// Require two approvals.
+	if err := env.SetApprovalsRequired(2); err != nil {
+		t.Errorf("Env SetApprovalsRequired failed: %s", err.Error())
+	}
+	if err := env.SetApprovalTTL("never"); err == nil {
+		t.Errorf("Env SetApprovalTTL should have failed for invalid TTL")
+	}
+
+	// Release without a request should fail, even when forced.
+	if err := env.Release("1.0.1", []string{}, "alice", true); err == nil {
+		t.Errorf("Env Release should have failed without approval")
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	// Approving without a request should fail.
+	if err := env.Approve("1.0.1", "bob"); err == nil {
+		t.Errorf("Env Approve should have failed without a request")
+	}
+
+	// Only deployed versions may be requested.
+	if err := env.RequestRelease("9.9.9", []string{}, "alice"); err == nil {
+		t.Errorf("Env RequestRelease should have failed for undeployed version")
+	}
+	if err := env.RequestRelease("1.0.1", []string{}, "alice"); err != nil {
+		t.Errorf("Env RequestRelease failed: %s", err.Error())
+	}
+	if err := env.RequestRelease("1.0.1", []string{}, "carol"); err == nil {
+		t.Errorf("Env RequestRelease should have failed as duplicate")
+	}
+
+	// The requester may not approve, and nobody may approve twice.
+	if err := env.Approve("1.0.1", "alice"); err == nil {
+		t.Errorf("Env Approve should have failed for the requester")
+	}
+	if err := env.Approve("1.0.1", "bob"); err != nil {
+		t.Errorf("Env Approve failed: %s", err.Error())
+	}
+	if err := env.Approve("1.0.1", "bob"); err == nil {
+		t.Errorf("Env Approve should have failed as duplicate")
+	}
+
+	// One approval is not enough.
+	if err := env.Release("1.0.1", []string{}, "alice", false); err == nil {
+		t.Errorf("Env Release should have failed with insufficient approvals")
+	}
+	if err := env.Approve("1.0.1", "carol"); err != nil {
+		t.Errorf("Env Approve failed: %s", err.Error())
+	}
+
+	// The approval covers only the requested hosts.
+	if err := env.Release("1.0.1", []string{"host1"}, "alice", false); err == nil {
+		t.Errorf("Env Release should have failed for different previewers")
+	}
+	if err := env.Release("1.0.1", []string{}, "alice", false); err != nil {
+		t.Errorf("Env Release failed: %s", err.Error())
+	}
+	if len(env.Requests) != 0 {
+		t.Errorf("Env Release did not consume the request")
+	}
+	if len(env.Approvals) != 4 || env.Approvals[0].Action != KAPR_RELEASED {
+		t.Errorf("Env approval history not recorded: %v", env.Approvals)
+	}
+
+	// A rejected request cannot be released.
+	env.RequestRelease("1.0.1", []string{}, "alice")
+	if err := env.Reject("1.0.1", "bob", "not during the sale"); err != nil {
+		t.Errorf("Env Reject failed: %s", err.Error())
+	}
+	if err := env.Approve("1.0.1", "carol"); err == nil {
+		t.Errorf("Env Approve should have failed after rejection")
+	}
+
+	// Expired requests are removed.
+	env.RequestRelease("1.0.1", []string{}, "alice")
+	env.expireRequests(time.Now().Add(25 * time.Hour))
+	if len(env.Requests) != 0 || env.Approvals[0].Action != KAPR_EXPIRED {
+		t.Errorf("Env request did not expire")
+	}
+}
@@ -0,0 +1,184 @@
+package repo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The longest freeze window permitted; bounds the search for a window start.
+const kMAX_FREEZE_DURATION = 31 * 24 * time.Hour
+
+/*
+FreezeWindow describes a recurring period during which an environment is locked.
+
+The Schedule is a cron-like specification of when the window opens, made up of
+five space-separated fields evaluated in local time:
+
+	minute (0-59) hour (0-23) day-of-month (1-31) month (1-12) day-of-week (0-7)
+
+Each field may be "*", a number, a range "a-b", a list "a,b,c", or any of these
+with a step "/n". As with cron, when both day-of-month and day-of-week are
+restricted, a day matching either one opens the window.
+*/
+type FreezeWindow struct {
+	Schedule string    `json:"schedule"`  // When the window opens, in cron format
+	Duration string    `json:"duration"`  // How long the window stays open, for example "48h"
+	Holder   string    `json:"holder"`    // The user who created the window
+	Reason   string    `json:"reason"`    // Why the environment is frozen
+	TS       time.Time `json:"timestamp"` // The time at which the window was created
+}
+
+func newFreezeWindow(schedule, duration, holder, reason string) (*FreezeWindow, error) {
+	fw := &FreezeWindow{schedule, duration, holder, reason, time.Now()}
+	if _, err := parseSchedule(schedule); err != nil {
+		return nil, err
+	}
+	if _, err := fw.duration(); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// ActiveAt indicates whether the window is open at the given time.
+func (fw *FreezeWindow) ActiveAt(t time.Time) bool {
+
+	sched, err := parseSchedule(fw.Schedule)
+	if err != nil {
+		return false
+	}
+	dur, err := fw.duration()
+	if err != nil {
+		return false
+	}
+
+	// Look back over the duration for a minute at which the window opened.
+	t = t.Local()
+	start := t.Truncate(time.Minute)
+	for elapsed := time.Duration(0); elapsed < dur; elapsed += time.Minute {
+		if candidate := start.Add(-elapsed); sched.matches(candidate) && t.Before(candidate.Add(dur)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fw *FreezeWindow) duration() (time.Duration, error) {
+	dur, err := time.ParseDuration(fw.Duration)
+	if err != nil {
+		return 0, fmt.Errorf("invalid freeze duration %q: %s", fw.Duration, err.Error())
+	}
+	if dur < time.Minute || dur > kMAX_FREEZE_DURATION {
+		return 0, fmt.Errorf("freeze duration %q must be between 1m and %s", fw.Duration, kMAX_FREEZE_DURATION)
+	}
+	return dur, nil
+}
+
+// schedule is the parsed form of a FreezeWindow Schedule.
+type schedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+func parseSchedule(spec string) (*schedule, error) {
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid freeze schedule %q: expected 5 fields, found %d", spec, len(fields))
+	}
+
+	var err error
+	s := new(schedule)
+	if s.minute, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid freeze schedule %q: minute: %s", spec, err.Error())
+	}
+	if s.hour, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid freeze schedule %q: hour: %s", spec, err.Error())
+	}
+	if s.dom, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid freeze schedule %q: day of month: %s", spec, err.Error())
+	}
+	if s.month, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid freeze schedule %q: month: %s", spec, err.Error())
+	}
+	if s.dow, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid freeze schedule %q: day of week: %s", spec, err.Error())
+	}
+
+	// Sunday may be given as either 0 or 7.
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	return s, nil
+}
+
+func parseScheduleField(field string, min, max int) (map[int]bool, error) {
+
+	values := make(map[int]bool)
+
+	for _, item := range strings.Split(field, ",") {
+
+		// Separate out the optional step.
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", item)
+			}
+			step = n
+			item = item[:i]
+		}
+
+		// Determine the range covered by this item.
+		lo, hi := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", item)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", item)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+
+		for n := lo; n <= hi; n += step {
+			values[n] = true
+		}
+	}
+
+	return values, nil
+}
+
+func (s *schedule) matches(t time.Time) bool {
+
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+
+	// Day matching follows cron: restricted day fields are ORed together.
+	domMatch := s.dom[t.Day()]
+	dowMatch := s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dowMatch
+	case s.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
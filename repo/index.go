@@ -15,9 +15,10 @@ type versionOnDelete func(versionName string)
 // Index is the repository index for an application.
 type Index struct {
 	appName  string              // The name of the application in this index
-	Canary   int                 `json:"canary"`       // Incremented each time the index is written out
-	Versions map[string]*Version `json:"versions"`     // The set of versions uploaded; old entries fall off
-	Envs     map[string]*Env     `json:"environments"` // The defined environments: prod, stage, etc.
+	Canary   int                 `json:"canary"`            // Incremented each time the index is written out
+	Versions map[string]*Version `json:"versions"`          // The set of versions uploaded; old entries fall off
+	Envs     map[string]*Env     `json:"environments"`      // The defined environments: prod, stage, etc.
+	DataKey  string              `json:"datakey,omitempty"` // The key for encrypted artifacts, wrapped by the master key
 }
 
 // NewIndex returns a new instance of Index.
@@ -195,6 +196,11 @@ func (ri *Index) IndexPath() string {
 	return ri.appName + "/index.json"
 }
 
+// ArtifactDirPath returns the canonical path to the directory holding the app's artifacts.
+func (ri *Index) ArtifactDirPath() string {
+	return path.Join(ri.appName, "versions") + "/"
+}
+
 // ArtifactPath returns the canonical path to the indicated artifact.
 func (ri *Index) ArtifactPath(filename string) string {
 	return path.Join(ri.appName, "versions", filename)
@@ -205,6 +211,49 @@ func (ri *Index) HMACPath(filename string) string {
 	return ri.ArtifactPath(filename) + ".hmac"
 }
 
+// BlobDirPath returns the canonical path to the directory holding the app's content-addressed artifacts.
+func (ri *Index) BlobDirPath() string {
+	return path.Join(ri.appName, "blobs") + "/"
+}
+
+// BlobPath returns the canonical path to the indicated content-addressed artifact.
+func (ri *Index) BlobPath(blobName string) string {
+	return path.Join(ri.appName, "blobs", blobName)
+}
+
+// VersionPath returns the path to a version's artifact: its blob if it has a
+// digest, or else its named artifact, as stored before deduplication.
+func (ri *Index) VersionPath(vers *Version) string {
+	if vers.Digest != "" {
+		return ri.BlobPath(vers.BlobName())
+	}
+	return ri.ArtifactPath(vers.Filename)
+}
+
+// VersionHMACPath returns the path to the HMAC for a version's artifact.
+func (ri *Index) VersionHMACPath(vers *Version) string {
+	return ri.VersionPath(vers) + ".hmac"
+}
+
+// DeltaPath returns the path to the delta for a version's artifact, if it has one;
+// it is named for both blobs, as versions with the same content may have different bases.
+func (ri *Index) DeltaPath(vers *Version) string {
+	if vers.Delta == nil {
+		return ""
+	}
+	return ri.VersionPath(vers) + ".delta-" + vers.Delta.BaseDigest
+}
+
+// BlobReferenced indicates whether any version other than exceptVersion uses the given blob.
+func (ri *Index) BlobReferenced(blobName, exceptVersion string) bool {
+	for versionName, vers := range ri.Versions {
+		if versionName != exceptVersion && vers.Digest != "" && vers.BlobName() == blobName {
+			return true
+		}
+	}
+	return false
+}
+
 // ArtifactFilename returns the canonical filename of the indicated artifact.
 func (ri *Index) ArtifactFilename(version, artifactType string) string {
 	return ri.appName + "-" + version + "." + artifactType
@@ -185,3 +185,64 @@ func TestIndexVersions(t *testing.T) {
 		t.Errorf("Index len(Versions[]) is %d, should be 1", len(ri.Versions))
 	}
 }
+
+func TestIndexBlobs(t *testing.T) {
+
+	ri := NewIndex("Example_App")
+	onDelete := func(versionName string) {}
+
+	// Ensure that minimum number of versions to keep is not zero.
+	if err := ri.AddEnv("dummy"); err != nil {
+		t.Errorf("Index AddEnv failed: %s", err.Error())
+	}
+
+	// A version without a digest keeps its named artifact.
+	if err := ri.AddVersion("1.0.0", "example_app-1.0.0.tar.gz", true, onDelete); err != nil {
+		t.Errorf("Index AddVersion failed: %s", err.Error())
+	}
+	legacy, _ := ri.GetVersion("1.0.0")
+	if p := ri.VersionPath(legacy); p != "example_app/versions/example_app-1.0.0.tar.gz" {
+		t.Errorf("Index VersionPath for legacy version is %q", p)
+	}
+	if p := ri.VersionHMACPath(legacy); p != "example_app/versions/example_app-1.0.0.tar.gz.hmac" {
+		t.Errorf("Index VersionHMACPath for legacy version is %q", p)
+	}
+
+	// Versions with the same content share a blob.
+	for _, versionName := range []string{"1.0.1", "1.0.2"} {
+		if err := ri.AddVersion(versionName, "example_app-"+versionName+".tar.gz", true, onDelete); err != nil {
+			t.Errorf("Index AddVersion failed: %s", err.Error())
+		}
+		vers, _ := ri.GetVersion(versionName)
+		vers.Digest = "abc123"
+	}
+	vers, _ := ri.GetVersion("1.0.1")
+	if p := ri.VersionPath(vers); p != "example_app/blobs/abc123" {
+		t.Errorf("Index VersionPath for blob is %q", p)
+	}
+	if !ri.BlobReferenced("abc123", "1.0.1") {
+		t.Errorf("Index BlobReferenced should be true while 1.0.2 uses the blob")
+	}
+	if err := ri.RmVersion("1.0.2"); err != nil {
+		t.Errorf("Index RmVersion failed: %s", err.Error())
+	}
+	if ri.BlobReferenced("abc123", "1.0.1") {
+		t.Errorf("Index BlobReferenced should be false once only 1.0.1 uses the blob")
+	}
+
+	// Encrypted blobs are distinct from plaintext ones with the same digest.
+	vers.Encrypted = true
+	if p := ri.VersionPath(vers); p != "example_app/blobs/abc123.encrypted" {
+		t.Errorf("Index VersionPath for encrypted blob is %q", p)
+	}
+
+	// A delta is stored beside the blob, named for its base.
+	vers.Encrypted = false
+	if p := ri.DeltaPath(vers); p != "" {
+		t.Errorf("Index DeltaPath without a delta is %q", p)
+	}
+	vers.Delta = &Delta{Base: "1.0.0", BaseDigest: "def456"}
+	if p := ri.DeltaPath(vers); p != "example_app/blobs/abc123.delta-def456" {
+		t.Errorf("Index DeltaPath is %q", p)
+	}
+}
@@ -31,17 +31,36 @@ func (vs *versionSorter) Less(i, j int) bool {
 
 // Version provides version and filename information for uploaded files.
 type Version struct {
-	Name     string    `json:"version"`   // The name of the version, expected to be similar to "1.0.0"
-	Filename string    `json:"filename"`  // The name of the uploaded tar file for this version
-	Released bool      `json:"released"`  // True if this version has ever been released
-	Enabled  bool      `json:"enabled"`   // False if this version has been specifically disabled; default True
-	TS       time.Time `json:"timestamp"` // The time when this version was uploaded
+	Name      string    `json:"version"`             // The name of the version, expected to be similar to "1.0.0"
+	Filename  string    `json:"filename"`            // The name of the uploaded tar file for this version
+	Released  bool      `json:"released"`            // True if this version has ever been released
+	Enabled   bool      `json:"enabled"`             // False if this version has been specifically disabled; default True
+	TS        time.Time `json:"timestamp"`           // The time when this version was uploaded
+	Encrypted bool      `json:"encrypted,omitempty"` // True if the artifact is encrypted with the index DataKey
+	Digest    string    `json:"digest,omitempty"`    // The SHA-256 of the artifact, which names its blob; empty for older versions
+	Size      int64     `json:"size,omitempty"`      // The length of the artifact before any encryption; 0 for older versions
+	Delta     *Delta    `json:"delta,omitempty"`     // An optional delta for rebuilding the artifact from an earlier one
+}
+
+// Delta identifies the version from whose artifact a delta rebuilds a version's artifact.
+type Delta struct {
+	Base       string `json:"base"`       // The name of the base version
+	BaseDigest string `json:"basedigest"` // The digest of the base version's artifact
 }
 
 func newVersion(versionName, fileName string, enabled bool) *Version {
 	return &Version{Name: versionName, Filename: fileName, Released: false, Enabled: enabled, TS: time.Now()}
 }
 
+// BlobName returns the name of the content-addressed blob holding the artifact.
+// The digest is of the plaintext, so encrypted blobs are kept distinct.
+func (vers *Version) BlobName() string {
+	if vers.Encrypted {
+		return vers.Digest + ".encrypted"
+	}
+	return vers.Digest
+}
+
 // Enable makes a version eligible to be released (the default state).
 func (vers *Version) Enable() {
 	vers.Enabled = true
@@ -16,6 +16,8 @@ func (ns NotifySource) String() string {
 		return "timer"
 	case KNS_ZK:
 		return "zk"
+	case KNS_DELAYED:
+		return "delayed"
 	default:
 		return fmt.Sprintf("unknown(%d)", ns)
 	}
@@ -23,9 +25,10 @@ func (ns NotifySource) String() string {
 
 // The values that may appear as the Source in a Notification.
 const (
-	KNS_FORCED NotifySource = iota // Notification was created externally to signaller
-	KNS_TIMER                      // Notification was triggered by a timer
-	KNS_ZK                         // Notification was triggered by Zookeeper
+	KNS_FORCED  NotifySource = iota // Notification was created externally to signaller
+	KNS_TIMER                       // Notification was triggered by a timer
+	KNS_ZK                          // Notification was triggered by Zookeeper
+	KNS_DELAYED                     // Notification was deferred by its recipient, to be handled later
 )
 
 /*
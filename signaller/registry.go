@@ -13,6 +13,8 @@ import (
 type hostInfo struct {
 	Version  string   // The version of the application this host is serving
 	Deployed []string // The versions currently available on this host
+	PeerURL  string   `json:",omitempty"` // Where this host serves artifacts to its peers
+	Problem  string   `json:",omitempty"` // The most recent failure to deploy or release
 }
 
 // RegistryInfo is used to present the information in the Registry.
@@ -22,6 +24,8 @@ type RegistryInfo struct {
 	Appname    string   // The name of the application this host is running
 	AppVersion string   // The version of the application this host is serving
 	Deployed   []string // The versions currently available on this host
+	PeerURL    string   // Where this host serves artifacts to its peers, if it does
+	Problem    string   // Why the host is not in sync with the repository, if it is not
 }
 
 // RegistryList is an array of RegistryInfo structures.
@@ -46,14 +50,21 @@ type Registry struct {
 // Register enters the name of the local machine into the hosts registry, along with the
 // currently released version and available deployments (requires Zookeeper).
 func (hr *Registry) Register(envName, appName, hostName, version string, deployed []string) {
+	hr.RegisterHost(RegistryInfo{Hostname: hostName, Envname: envName, Appname: appName,
+		AppVersion: version, Deployed: deployed})
+}
+
+// RegisterHost is Register with all the information a host can provide, such as
+// where it serves artifacts to its peers, and any problem it has (requires Zookeeper).
+func (hr *Registry) RegisterHost(info RegistryInfo) {
 	if zkConn := hr.sgnlr.getZKConnWithLock(); zkConn != nil {
 
-		hostinfo := hostInfo{version, deployed}
+		hostinfo := hostInfo{info.AppVersion, info.Deployed, info.PeerURL, info.Problem}
 		data, _ := json.MarshalIndent(hostinfo, "", "    ")
 
 		flags := int32(zk.FlagEphemeral)
 		acl := zk.WorldACL(zk.PermAll)
-		registryPath := hr.makeRegistryPath(envName, appName, hostName)
+		registryPath := hr.makeRegistryPath(info.Envname, info.Appname, info.Hostname)
 		hr.sgnlr.makeParentNodes(registryPath)
 		if _, err := zkConn.Create(registryPath, data, flags, acl); err != nil {
 			zkConn.Set(registryPath, data, -1)
@@ -75,17 +86,17 @@ func (hr *Registry) Unregister(envName, appName, hostName string) {
 func (hr *Registry) Hosts(envName, appName string) []RegistryInfo {
 
 	var ri = make(registryList, 0)
-	var hostinfo hostInfo
 
 	if zkConn := hr.sgnlr.getZKConnWithLock(); zkConn != nil {
 		registryPath := hr.makeRegistryPath(envName, appName, "")
 		data := make([]byte, 2048)
 		hosts, _, _ := zkConn.Children(registryPath)
 		for _, host := range hosts {
+			var hostinfo hostInfo
 			data, _, _ = zkConn.Get(registryPath + "/" + host)
 			decoder := json.NewDecoder(bytes.NewReader(data))
 			decoder.Decode(&hostinfo)
-			ri = append(ri, RegistryInfo{host, envName, appName, hostinfo.Version, hostinfo.Deployed})
+			ri = append(ri, RegistryInfo{host, envName, appName, hostinfo.Version, hostinfo.Deployed, hostinfo.PeerURL, hostinfo.Problem})
 		}
 	}
 	sort.Sort(ri)
@@ -20,9 +20,9 @@ func withZookeeper(t *testing.T) {
 
 	// Instantiate and open the Signaller.
 	sgnlr := New(&pdconfig.SignallerConfig{
-		1,
-		5,
-		pdconfig.ZookeeperConfig{[]string{"localhost:2181"}, "/pulldeploy"},
+		PollInterval: 1,
+		PollFallback: 5,
+		ZK:           pdconfig.ZookeeperConfig{Servers: []string{"localhost:2181"}, BaseNode: "/pulldeploy"},
 	}, nil)
 	notifChan := sgnlr.Open()
 	defer sgnlr.Close()
@@ -34,9 +34,9 @@ func withoutZookeeper(t *testing.T) {
 
 	// Instantiate and open the Signaller.
 	sgnlr := New(&pdconfig.SignallerConfig{
-		1,
-		5,
-		pdconfig.ZookeeperConfig{[]string{}, ""},
+		PollInterval: 1,
+		PollFallback: 5,
+		ZK:           pdconfig.ZookeeperConfig{Servers: []string{}, BaseNode: ""},
 	}, nil)
 	notifChan := sgnlr.Open()
 	defer sgnlr.Close()
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+Repository data is read over HTTP(S), for example from nginx or a CDN fronting
+the repository. This access method is read-only, and suits app hosts, which
+need no credentials for the underlying storage.
+
+Valid Params for KST_HTTP:
+
+	* "baseurl"     The URL of the repository root, for example "https://repo.example.com/pulldeploy"
+	* "bearertoken" An optional token sent as "Authorization: Bearer <token>"
+	* "username"    An optional username for HTTP Basic authentication
+	* "password"    The password for HTTP Basic authentication
+	* "cabundle"    An optional PEM file of CA certificates for verifying the server
+*/
+const KST_HTTP AccessMethod = "http"
+
+// How long to wait for a server to begin responding.
+const kHTTP_RESPONSE_TIMEOUT = 60 * time.Second
+
+// stHTTP is used for read-only access to PullDeploy repositories over HTTP(S).
+type stHTTP struct {
+	baseURL     string       // The URL of the repository root, without a trailing "/"
+	bearerToken string       // Optional bearer token
+	username    string       // Optional Basic authentication username
+	password    string       // Optional Basic authentication password
+	client      *http.Client // The client used for all requests
+}
+
+// Initialize the repository object.
+func (st *stHTTP) init(params Params) error {
+
+	// Extract and validate the base URL.
+	baseURL, ok := params["baseurl"]
+	if !ok {
+		return fmt.Errorf("Storage initialization error: %q is a required parameter", "baseurl")
+	}
+	if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Storage initialization error: invalid baseurl %q", baseURL)
+	}
+	st.baseURL = strings.TrimSuffix(baseURL, "/")
+
+	// Extract the optional credentials.
+	st.bearerToken = params["bearertoken"]
+	st.username = params["username"]
+	st.password = params["password"]
+	if st.bearerToken != "" && st.username != "" {
+		return fmt.Errorf("Storage initialization error: use either bearertoken or username, not both")
+	}
+
+	// Set up the client, trusting the given CA certificates if any.
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: kHTTP_RESPONSE_TIMEOUT,
+	}
+	if caBundle, ok := params["cabundle"]; ok && caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return fmt.Errorf("Storage initialization error: cabundle: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Storage initialization error: cabundle: no certificates found in %q", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	st.client = &http.Client{Transport: transport}
+
+	return nil
+}
+
+// Get fetches the contents of a repository file into a byte array.
+func (st *stHTTP) Get(repoPath string) ([]byte, error) {
+	rc, err := st.GetReader(repoPath)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// Put is not supported by this read-only access method.
+func (st *stHTTP) Put(repoPath string, data []byte) error {
+	return st.readOnly("Put", repoPath)
+}
+
+// GetReader returns a stream handle for reading a repository file.
+func (st *stHTTP) GetReader(repoPath string) (io.ReadCloser, error) {
+	resp, err := st.request("GET", repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PutReader is not supported by this read-only access method.
+func (st *stHTTP) PutReader(repoPath string, rc io.ReadCloser, length int64) error {
+	rc.Close()
+	return st.readOnly("PutReader", repoPath)
+}
+
+// Delete is not supported by this read-only access method.
+func (st *stHTTP) Delete(repoPath string) error {
+	return st.readOnly("Delete", repoPath)
+}
+
+// List is not supported, as HTTP offers no standard way to enumerate files.
+func (st *stHTTP) List(prefix string) ([]FileInfo, error) {
+	return nil, fmt.Errorf("List is not supported by the %q access method", KST_HTTP)
+}
+
+// Stat returns the size and modification time of a repository file.
+func (st *stHTTP) Stat(repoPath string) (FileInfo, error) {
+	resp, err := st.request("HEAD", repoPath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{strings.TrimPrefix(repoPath, "/"), resp.ContentLength, modTime}, nil
+}
+
+// Exists indicates whether a repository file is present.
+func (st *stHTTP) Exists(repoPath string) (bool, error) {
+	req, err := st.newRequest("HEAD", repoPath)
+	if err != nil {
+		return false, err
+	}
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("Error while checking %q: %s", repoPath, err.Error())
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Error while checking %q: %s", repoPath, resp.Status)
+	}
+}
+
+// PutMultipart is not supported by this read-only access method.
+func (st *stHTTP) PutMultipart(repoPath string, r io.Reader, length, partSize int64) error {
+	return st.readOnly("PutMultipart", repoPath)
+}
+
+// Lock is not supported by this read-only access method.
+func (st *stHTTP) Lock(repoPath string) (func(), error) {
+	return nil, st.readOnly("Lock", repoPath)
+}
+
+// Utility helper to report an attempt to modify the repository.
+func (st *stHTTP) readOnly(operation, repoPath string) error {
+	return fmt.Errorf("%s %q: the %q access method is read-only", operation, repoPath, KST_HTTP)
+}
+
+// Utility helper to make an authenticated request for a repository file.
+func (st *stHTTP) newRequest(method, repoPath string) (*http.Request, error) {
+	escaped := (&url.URL{Path: strings.TrimPrefix(repoPath, "/")}).EscapedPath()
+	req, err := http.NewRequest(method, st.baseURL+"/"+escaped, nil)
+	if err != nil {
+		return nil, err
+	}
+	if st.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+st.bearerToken)
+	} else if st.username != "" {
+		req.SetBasicAuth(st.username, st.password)
+	}
+	return req, nil
+}
+
+// Utility helper to make a request, treating anything but 200 OK as an error.
+func (st *stHTTP) request(method, repoPath string) (*http.Response, error) {
+	req, err := st.newRequest(method, repoPath)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error while fetching %q: %s", repoPath, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("Not found: %s", req.URL.String())
+		}
+		return nil, fmt.Errorf("Error while fetching %q: %s", repoPath, resp.Status)
+	}
+	return resp, nil
+}
@@ -1,11 +1,16 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 /*
@@ -17,6 +22,16 @@ Valid Params for KST_LOCAL:
 */
 const KST_LOCAL AccessMethod = "local"
 
+// The suffix of the temporary file in which a multipart write is assembled.
+const kPARTIAL_SUFFIX = ".partial"
+
+// The suffixes of the hidden files used for atomic writes and locking.
+const kTEMP_SUFFIX = ".tmp"
+const kLOCK_SUFFIX = ".lock"
+
+// How long Lock waits for another holder to release a lock.
+var lockTimeout = 30 * time.Second
+
 // stLocal is used for PullDeploy repositories on the local filesystem.
 type stLocal struct {
 	baseDir string // The root directory of the repo in the local filesystem
@@ -25,7 +40,7 @@ type stLocal struct {
 // Initialize the repository object.
 func (st *stLocal) init(params Params) error {
 	if baseDir, ok := params["basedir"]; ok {
-		st.baseDir = absPath(baseDir)
+		st.baseDir = path.Clean(absPath(baseDir))
 		if _, err := os.Stat(st.baseDir); err != nil {
 			return fmt.Errorf("Storage initialization error: basedir: %s", err.Error())
 		}
@@ -58,7 +73,7 @@ func (st *stLocal) Put(repoPath string, data []byte) error {
 		}
 	}
 
-	return ioutil.WriteFile(fullPath, data, 0644)
+	return writeFileAtomic(fullPath, bytes.NewReader(data), 0644)
 }
 
 // GetReader returns a stream handle for reading a repository file.
@@ -87,15 +102,7 @@ func (st *stLocal) PutReader(repoPath string, rc io.ReadCloser, length int64) er
 		}
 	}
 
-	// Open the file, and write the data into it.
-	if fp, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0664); err == nil {
-		defer fp.Close()
-		if _, err := io.Copy(fp, rc); err != nil {
-			return fmt.Errorf("Error while creating %q: %s", fullPath, err.Error())
-		}
-	}
-
-	return nil
+	return writeFileAtomic(fullPath, rc, 0664)
 }
 
 // Delete removes a repository file.
@@ -110,6 +117,232 @@ func (st *stLocal) Delete(repoPath string) error {
 	return os.Remove(fullPath)
 }
 
+// List enumerates the repository files whose paths begin with prefix.
+func (st *stLocal) List(prefix string) ([]FileInfo, error) {
+
+	var list []FileInfo = []FileInfo{}
+
+	// Walk the deepest directory named by the prefix.
+	prefix = strings.TrimPrefix(prefix, "/")
+	walkDir := path.Join(st.baseDir, prefix[:strings.LastIndex(prefix, "/")+1])
+	if _, err := os.Stat(walkDir); os.IsNotExist(err) {
+		return list, nil
+	}
+
+	// Visitor to collect the matching files.
+	var listFunc = func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !isLocalWorkFile(fullPath) {
+			repoPath := strings.TrimPrefix(filepath.ToSlash(fullPath), st.baseDir+"/")
+			if strings.HasPrefix(repoPath, prefix) {
+				list = append(list, FileInfo{repoPath, info.Size(), info.ModTime()})
+			}
+		}
+		return nil
+	}
+
+	if err := filepath.Walk(walkDir, listFunc); err != nil {
+		return nil, fmt.Errorf("Error while listing %q: %s", prefix, err.Error())
+	}
+
+	return list, nil
+}
+
+// Stat returns the size and modification time of a repository file.
+func (st *stLocal) Stat(repoPath string) (FileInfo, error) {
+
+	// Generate the filename, and check that path exists.
+	fullPath, _ := makeLocalPath(st.baseDir, repoPath)
+	info, err := os.Stat(fullPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return FileInfo{}, fmt.Errorf("Not found: %s", fullPath)
+	}
+
+	return FileInfo{strings.TrimPrefix(repoPath, "/"), info.Size(), info.ModTime()}, nil
+}
+
+// Exists indicates whether a repository file is present.
+func (st *stLocal) Exists(repoPath string) (bool, error) {
+	fullPath, _ := makeLocalPath(st.baseDir, repoPath)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+// PutMultipart writes a stream to a repository file in parts of partSize bytes.
+// The parts are assembled in a temporary file alongside the repository file,
+// which is renamed into place once complete. If an earlier attempt was
+// interrupted, parts already present in the temporary file are not rewritten;
+// the stream is always read in full, so that it may be tee'd elsewhere.
+func (st *stLocal) PutMultipart(repoPath string, r io.Reader, length, partSize int64) error {
+
+	if partSize <= 0 {
+		return fmt.Errorf("Invalid part size: %d", partSize)
+	}
+
+	// Generate the filename, and ensure path exists.
+	fullPath, exists := makeLocalPath(st.baseDir, repoPath)
+	if !exists {
+		if err := os.MkdirAll(path.Dir(fullPath), 0755); err != nil {
+			return fmt.Errorf("Error while creating %q: %s", fullPath, err.Error())
+		}
+	}
+
+	// Open the partial file left by any earlier attempt.
+	partialPath := fullPath + kPARTIAL_SUFFIX
+	fp, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return fmt.Errorf("Error while creating %q: %s", partialPath, err.Error())
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("Error while creating %q: %s", partialPath, err.Error())
+	}
+	resumeSize := info.Size()
+
+	// Copy the stream a part at a time, skipping parts already written.
+	buf := make([]byte, partSize)
+	existing := make([]byte, partSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			part := buf[:n]
+			if offset+int64(n) > resumeSize || !partMatches(fp, offset, part, existing[:n]) {
+				if _, err := fp.WriteAt(part, offset); err != nil {
+					return fmt.Errorf("Error while writing %q: %s", partialPath, err.Error())
+				}
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error while reading data for %q: %s", fullPath, err.Error())
+		}
+	}
+	if offset != length {
+		return fmt.Errorf("Error while writing %q: expected %d bytes, read %d", fullPath, length, offset)
+	}
+
+	// Discard anything beyond the end of the data, and make it durable.
+	if err := fp.Truncate(offset); err != nil {
+		return fmt.Errorf("Error while writing %q: %s", partialPath, err.Error())
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("Error while writing %q: %s", partialPath, err.Error())
+	}
+
+	return os.Rename(partialPath, fullPath)
+}
+
+// Lock takes an advisory lock associated with a repository file, waiting a
+// limited time for any other holder to release it. The lock is held on a
+// separate lock file, so that the repository file itself may be replaced.
+func (st *stLocal) Lock(repoPath string) (func(), error) {
+
+	// Generate the lock filename, and ensure path exists.
+	fullPath, _ := makeLocalPath(st.baseDir, repoPath)
+	lockPath := path.Join(path.Dir(fullPath), "."+path.Base(fullPath)+kLOCK_SUFFIX)
+	if err := os.MkdirAll(path.Dir(lockPath), 0755); err != nil {
+		return nil, fmt.Errorf("Error while creating %q: %s", lockPath, err.Error())
+	}
+
+	fp, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, fmt.Errorf("Error while locking %q: %s", repoPath, err.Error())
+	}
+
+	// Poll for the lock, so that a stuck holder does not hang us forever.
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			fp.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("Timed out waiting for lock on %q; another user may be updating it", repoPath)
+			}
+			return nil, fmt.Errorf("Error while locking %q: %s", repoPath, err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	unlock := func() {
+		syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+		fp.Close()
+	}
+	return unlock, nil
+}
+
+// Utility helper to write a file so that readers see either the old or the
+// new contents, never a partial write: the data goes to a temporary file in
+// the same directory, which is synced and renamed into place.
+func writeFileAtomic(fullPath string, r io.Reader, perm os.FileMode) error {
+
+	fp, err := ioutil.TempFile(path.Dir(fullPath), "."+path.Base(fullPath)+kTEMP_SUFFIX)
+	if err != nil {
+		return fmt.Errorf("Error while creating %q: %s", fullPath, err.Error())
+	}
+	tempPath := fp.Name()
+
+	// Clean up the temporary file if anything goes wrong.
+	fail := func(err error) error {
+		fp.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("Error while creating %q: %s", fullPath, err.Error())
+	}
+
+	if _, err := io.Copy(fp, r); err != nil {
+		return fail(err)
+	}
+	if err := fp.Chmod(perm); err != nil {
+		return fail(err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Error while creating %q: %s", fullPath, err.Error())
+	}
+	if err := os.Rename(tempPath, fullPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("Error while creating %q: %s", fullPath, err.Error())
+	}
+
+	return nil
+}
+
+// Utility helper to identify the temporary, partial and lock files that are
+// not part of the repository proper.
+func isLocalWorkFile(fullPath string) bool {
+	return strings.HasPrefix(path.Base(fullPath), ".") || strings.HasSuffix(fullPath, kPARTIAL_SUFFIX)
+}
+
+// Utility helper to compare a part with what is already in a file.
+func partMatches(fp *os.File, offset int64, part, existing []byte) bool {
+	if _, err := fp.ReadAt(existing, offset); err != nil {
+		return false
+	}
+	for i := range part {
+		if part[i] != existing[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // Utility helper to generate a local repository full path.
 func makeLocalPath(baseDir, repoPath string) (string, bool) {
 	fullpath := path.Join(baseDir, repoPath)
@@ -1,31 +1,71 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
 )
 
 /*
-Repository data is stored in Amazon S3.
+Repository data is stored in Amazon S3, or an S3-compatible service such as MinIO or Ceph.
 
 Valid Params for KST_S3:
 
-	* "awsregion"   The code for the AWS Region, for example "us-east-1"
-	* "bucket"      The name of the AWS bucket
-	* "prefix"      An optional prefix for the bucket contents, for example "pulldeploy"
+	* "awsregion"       The code for the AWS Region, for example "us-east-1"
+	* "bucket"          The name of the AWS bucket
+	* "prefix"          An optional prefix for the bucket contents, for example "pulldeploy"
+	* "endpoint"        An optional URL for an S3-compatible service, for example "https://minio.example.com:9000"
+	* "pathstyle"       "true" to address the bucket in the path rather than the host name;
+	                    the default is "true" with a custom endpoint, "false" otherwise
+	* "cabundle"        An optional PEM file of CA certificates for verifying the endpoint
+	* "credentials"     Where to find credentials: "env" (the default), "shared", "instance", or "auto"
+	* "profile"         The profile to use from the shared credentials file (default "default")
+	* "credentialsfile" The shared credentials file (default "~/.aws/credentials")
+
+The "env" credentials are AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. The "instance"
+credentials come only from the EC2 instance role, and "auto" tries the environment, then
+the shared file, then the instance role. Temporary credentials are renewed before they
+expire.
 */
 const KST_S3 AccessMethod = "s3"
 
+// The smallest part permitted in an S3 multipart upload, other than the last.
+const kMIN_S3_PART_SIZE = 5 * 1024 * 1024
+
+// Where the credentials of the EC2 instance role are found.
+const kEC2_METADATA_URL = "http://169.254.169.254/latest/"
+const kEC2_METADATA_TIMEOUT = 5 * time.Second
+
 // stS3 is used for PullDeploy repositories in Amazon S3.
 type stS3 struct {
-	regionName string     // Name of the AWS Region with our bucket
-	bucketName string     // Name of the S3 bucket
-	pathPrefix string     // Optional prefix to namespace our bucket
-	bucket     *s3.Bucket // Handle to the S3 bucket
+	regionName      string       // Name of the AWS Region with our bucket
+	bucketName      string       // Name of the S3 bucket
+	pathPrefix      string       // Optional prefix to namespace our bucket
+	credentials     string       // The source of the credentials
+	credentialsFile string       // The shared credentials file, if configured
+	profile         string       // The profile in the shared credentials file, if configured
+	region          aws.Region   // The region, or the custom endpoint standing in for one
+	client          *http.Client // The client trusting a private CA bundle, if configured
+	mu              sync.Mutex   // Serializes the renewal of credentials
+	bucket          *s3.Bucket   // Handle to the S3 bucket
 }
 
 // Initialize the repository object.
@@ -46,39 +86,44 @@ func (st *stS3) init(params Params) error {
 		st.pathPrefix = pathPrefix
 	}
 
-	// Validate the region.
-	region, ok := aws.Regions[st.regionName]
-	if !ok {
-		validSet := ""
-		for k := range aws.Regions {
-			validSet += " " + k
+	// Determine the region, which may be a custom endpoint.
+	region, err := makeS3Region(st.regionName, params)
+	if err != nil {
+		return err
+	}
+	st.region = region
+
+	// Use the supplied CA certificates, as well as the system's, to verify the endpoint.
+	if caBundle, ok := params["cabundle"]; ok && caBundle != "" {
+		if st.client, err = makeS3Client(caBundle); err != nil {
+			return err
 		}
-		return fmt.Errorf("Invalid AWS region name: '%s' Valid values:%s",
-			st.regionName, validSet)
 	}
 
-	// Pull AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY out of the environment.
-	auth, err := aws.EnvAuth()
+	// Obtain the credentials.
+	st.credentials = params["credentials"]
+	st.credentialsFile = params["credentialsfile"]
+	st.profile = params["profile"]
+	auth, err := getS3Auth(st.credentials, st.credentialsFile, st.profile)
 	if err != nil {
 		return err
 	}
 
 	// Open a handle to the bucket.
-	s := s3.New(auth, region)
-	st.bucket = s.Bucket(st.bucketName)
+	st.bucket = st.newBucket(auth)
 
 	return nil
 }
 
 // Get fetches the contents of a repository file into a byte array.
 func (st *stS3) Get(repoPath string) ([]byte, error) {
-	return st.bucket.Get(st.makeS3Path(repoPath))
+	return st.getBucket().Get(st.makeS3Path(repoPath))
 }
 
 // Put writes the contents of a byte array into a repository file.
 func (st *stS3) Put(repoPath string, data []byte) error {
 	options := s3.Options{}
-	return st.bucket.Put(
+	return st.getBucket().Put(
 		st.makeS3Path(repoPath),
 		data,
 		"application/octet-stream",
@@ -89,13 +134,13 @@ func (st *stS3) Put(repoPath string, data []byte) error {
 
 // GetReader returns a stream handle for reading a repository file.
 func (st *stS3) GetReader(repoPath string) (io.ReadCloser, error) {
-	return st.bucket.GetReader(st.makeS3Path(repoPath))
+	return st.getBucket().GetReader(st.makeS3Path(repoPath))
 }
 
 // PutReader writes a stream to a repository file.
 func (st *stS3) PutReader(repoPath string, rc io.ReadCloser, length int64) error {
 	options := s3.Options{}
-	return st.bucket.PutReader(
+	return st.getBucket().PutReader(
 		st.makeS3Path(repoPath),
 		rc,
 		length,
@@ -107,7 +152,152 @@ func (st *stS3) PutReader(repoPath string, rc io.ReadCloser, length int64) error
 
 // Delete removes a repository file.
 func (st *stS3) Delete(repoPath string) error {
-	return st.bucket.Del(st.makeS3Path(repoPath))
+	return st.getBucket().Del(st.makeS3Path(repoPath))
+}
+
+// List enumerates the repository files whose paths begin with prefix.
+func (st *stS3) List(prefix string) ([]FileInfo, error) {
+
+	var list []FileInfo = []FileInfo{}
+
+	// Preserve any trailing "/", which path.Join would remove.
+	s3Prefix := st.makeS3Path(strings.TrimPrefix(prefix, "/"))
+	if strings.HasSuffix(prefix, "/") && !strings.HasSuffix(s3Prefix, "/") {
+		s3Prefix += "/"
+	}
+	if s3Prefix == "/" {
+		s3Prefix = ""
+	}
+
+	// Retrieve the listing a page at a time.
+	marker := ""
+	for {
+		resp, err := st.getBucket().List(s3Prefix, "", marker, 1000)
+		if err != nil {
+			return nil, fmt.Errorf("Error while listing %q: %s", prefix, err.Error())
+		}
+		for _, key := range resp.Contents {
+			modTime, _ := time.Parse(time.RFC3339Nano, key.LastModified)
+			list = append(list, FileInfo{st.makeRepoPath(key.Key), key.Size, modTime})
+			marker = key.Key
+		}
+		if !resp.IsTruncated {
+			break
+		}
+		if resp.NextMarker != "" {
+			marker = resp.NextMarker
+		}
+	}
+
+	return list, nil
+}
+
+// Stat returns the size and modification time of a repository file.
+func (st *stS3) Stat(repoPath string) (FileInfo, error) {
+
+	resp, err := st.getBucket().Head(st.makeS3Path(repoPath), nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{strings.TrimPrefix(repoPath, "/"), resp.ContentLength, modTime}, nil
+}
+
+// Exists indicates whether a repository file is present.
+func (st *stS3) Exists(repoPath string) (bool, error) {
+	return st.getBucket().Exists(st.makeS3Path(repoPath))
+}
+
+// PutMultipart writes a stream to a repository file using an S3 multipart upload,
+// in parts of partSize bytes. If an earlier upload to the same path was
+// interrupted, it is resumed, and parts already uploaded intact are skipped;
+// the stream is always read in full, so that it may be tee'd elsewhere.
+func (st *stS3) PutMultipart(repoPath string, r io.Reader, length, partSize int64) error {
+
+	if partSize < kMIN_S3_PART_SIZE {
+		return fmt.Errorf("Invalid part size: %d; S3 requires at least %d", partSize, kMIN_S3_PART_SIZE)
+	}
+
+	// Small files need only a single request.
+	if length <= partSize {
+		return st.PutReader(repoPath, ioutil.NopCloser(r), length)
+	}
+
+	// Start a new upload, or find the one that was interrupted.
+	multi, err := st.getBucket().Multi(st.makeS3Path(repoPath), "application/octet-stream", "authenticated-read", s3.Options{})
+	if err != nil {
+		return fmt.Errorf("Error while starting upload of %q: %s", repoPath, err.Error())
+	}
+	uploaded := make(map[int]s3.Part)
+	if parts, err := multi.ListParts(); err == nil {
+		for _, part := range parts {
+			uploaded[part.N] = part
+		}
+	}
+
+	// Upload the stream a part at a time.
+	buf := make([]byte, partSize)
+	parts := make([]s3.Part, 0)
+	var total int64
+	for n := 1; ; n++ {
+		count, err := io.ReadFull(r, buf)
+		if count > 0 {
+			data := buf[:count]
+			total += int64(count)
+			sum := md5.Sum(data)
+			if part, ok := uploaded[n]; ok && part.Size == int64(count) &&
+				strings.Trim(part.ETag, "\"") == hex.EncodeToString(sum[:]) {
+				parts = append(parts, part)
+			} else if part, err := multi.PutPart(n, bytes.NewReader(data)); err == nil {
+				parts = append(parts, part)
+			} else {
+				// Leave the upload in place, so that it may be resumed.
+				return fmt.Errorf("Error while uploading part %d of %q (run again to resume): %s",
+					n, repoPath, err.Error())
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error while reading data for %q: %s", repoPath, err.Error())
+		}
+	}
+	if total != length {
+		multi.Abort()
+		return fmt.Errorf("Error while uploading %q: expected %d bytes, read %d", repoPath, length, total)
+	}
+
+	return multi.Complete(parts)
+}
+
+// Lock is a no-op for S3, which offers no locking primitive; concurrent
+// updates to the same repository file are resolved by the last writer.
+func (st *stS3) Lock(repoPath string) (func(), error) {
+	return func() {}, nil
+}
+
+// getBucket returns the bucket handle, first renewing temporary credentials
+// that are about to expire. A renewal replaces the handle rather than changing
+// it, so that requests already made with the old one are unaffected.
+func (st *stS3) getBucket() *s3.Bucket {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if exp := st.bucket.S3.Auth.Expiration(); !exp.IsZero() && time.Now().Add(5*time.Minute).After(exp) {
+		if auth, err := getS3Auth(st.credentials, st.credentialsFile, st.profile); err == nil {
+			st.bucket = st.newBucket(auth)
+		}
+	}
+	return st.bucket
+}
+
+// newBucket opens a handle to the bucket with the given credentials.
+func (st *stS3) newBucket(auth aws.Auth) *s3.Bucket {
+	if st.client != nil {
+		return s3.New(auth, st.region, st.client).Bucket(st.bucketName)
+	}
+	return s3.New(auth, st.region).Bucket(st.bucketName)
 }
 
 // Utility helper to generate a full S3 repository path.
@@ -117,3 +307,209 @@ func (st *stS3) makeS3Path(repoPath string) string {
 	}
 	return path.Join(st.pathPrefix, repoPath)
 }
+
+// Utility helper to convert a full S3 path back to a repository path.
+func (st *stS3) makeRepoPath(s3Path string) string {
+	if st.pathPrefix == "" {
+		return s3Path
+	}
+	return strings.TrimPrefix(s3Path, strings.TrimSuffix(st.pathPrefix, "/")+"/")
+}
+
+// Utility helper to determine the region, or the custom endpoint standing in for one.
+func makeS3Region(regionName string, params Params) (aws.Region, error) {
+
+	pathStyle := false
+	if s, ok := params["pathstyle"]; ok && s != "" {
+		var err error
+		if pathStyle, err = strconv.ParseBool(s); err != nil {
+			return aws.Region{}, fmt.Errorf("Invalid pathstyle: %q", s)
+		}
+	} else {
+		pathStyle = params["endpoint"] != ""
+	}
+
+	// A custom endpoint does not need to be a known AWS region.
+	if endpoint := params["endpoint"]; endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return aws.Region{}, fmt.Errorf("Invalid S3 endpoint: %q", endpoint)
+		}
+		if regionName == "" {
+			regionName = "us-east-1"
+		}
+		region := aws.Region{Name: regionName, S3Endpoint: u.Scheme + "://" + u.Host}
+		if !pathStyle {
+			region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+		}
+		return region, nil
+	}
+
+	// Validate the region.
+	region, ok := aws.Regions[regionName]
+	if !ok {
+		validSet := ""
+		for k := range aws.Regions {
+			validSet += " " + k
+		}
+		return aws.Region{}, fmt.Errorf("Invalid AWS region name: '%s' Valid values:%s",
+			regionName, validSet)
+	}
+	if pathStyle {
+		region.S3BucketEndpoint = ""
+	}
+
+	return region, nil
+}
+
+// Utility helper to obtain credentials from the configured source.
+func getS3Auth(source, credentialsFile, profile string) (aws.Auth, error) {
+	switch source {
+	case "", "env":
+		// Pull AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY out of the environment.
+		return aws.EnvAuth()
+	case "shared":
+		return sharedS3Auth(credentialsFile, profile)
+	case "instance":
+		return instanceS3Auth()
+	case "auto":
+		if auth, err := aws.EnvAuth(); err == nil {
+			return auth, nil
+		}
+		if auth, err := sharedS3Auth(credentialsFile, profile); err == nil {
+			return auth, nil
+		}
+		return instanceS3Auth()
+	default:
+		return aws.Auth{}, fmt.Errorf("Invalid S3 credentials source: %q", source)
+	}
+}
+
+// Utility helper to read a profile from an AWS shared credentials file.
+func sharedS3Auth(credentialsFile, profile string) (aws.Auth, error) {
+
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if credentialsFile == "" {
+		credentialsFile = path.Join(os.Getenv("HOME"), ".aws", "credentials")
+	}
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	fp, err := os.Open(credentialsFile)
+	if err != nil {
+		return aws.Auth{}, fmt.Errorf("Unable to read S3 credentials: %s", err.Error())
+	}
+	defer fp.Close()
+
+	// Collect the keys in the requested profile section.
+	values := make(map[string]string)
+	inProfile := false
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+		if kv := strings.SplitN(line, "=", 2); inProfile && len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	accessKey, secretKey := values["aws_access_key_id"], values["aws_secret_access_key"]
+	if accessKey == "" || secretKey == "" {
+		return aws.Auth{}, fmt.Errorf("No S3 credentials for profile %q in %s", profile, credentialsFile)
+	}
+
+	return *aws.NewAuth(accessKey, secretKey, values["aws_session_token"], time.Time{}), nil
+}
+
+// Utility helper to obtain the temporary credentials of the EC2 instance role,
+// using a session token for the metadata service where it requires one.
+func instanceS3Auth() (aws.Auth, error) {
+
+	client := &http.Client{Timeout: kEC2_METADATA_TIMEOUT}
+	var token string
+	if req, err := http.NewRequest("PUT", kEC2_METADATA_URL+"api/token", nil); err == nil {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+		if resp, err := client.Do(req); err == nil {
+			if body, err := ioutil.ReadAll(resp.Body); err == nil && resp.StatusCode == http.StatusOK {
+				token = string(body)
+			}
+			resp.Body.Close()
+		}
+	}
+	var getMetadata = func(item string) ([]byte, error) {
+		req, err := http.NewRequest("GET", kEC2_METADATA_URL+"meta-data/iam/security-credentials/"+item, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	// The first role attached to the instance provides the credentials.
+	roles, err := getMetadata("")
+	if err != nil {
+		return aws.Auth{}, fmt.Errorf("Unable to find the instance role: %s", err.Error())
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return aws.Auth{}, fmt.Errorf("Unable to find the instance role: no role attached")
+	}
+	data, err := getMetadata(role)
+	if err != nil {
+		return aws.Auth{}, fmt.Errorf("Unable to read credentials for instance role %q: %s", role, err.Error())
+	}
+	var cred struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(data, &cred); err != nil || cred.AccessKeyId == "" {
+		return aws.Auth{}, fmt.Errorf("Invalid credentials for instance role %q", role)
+	}
+
+	return *aws.NewAuth(cred.AccessKeyId, cred.SecretAccessKey, cred.Token, cred.Expiration), nil
+}
+
+// Utility helper to make a client that verifies TLS endpoints with a private CA
+// bundle, in addition to the system's own roots.
+func makeS3Client(caBundle string) (*http.Client, error) {
+	pem, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cabundle: %s", err.Error())
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Invalid cabundle: no certificates found in %q", caBundle)
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return &http.Client{Transport: transport}, nil
+}
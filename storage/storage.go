@@ -4,6 +4,7 @@ package storage
 import (
 	"fmt"
 	"io"
+	"time"
 )
 
 // Params is how storage-type-specific parameters are passed to New.
@@ -11,12 +12,24 @@ type Params map[string]string
 
 // Storage provides methods to set and get repository data.
 type Storage interface {
-	init(params Params) error                                        // Set up access parameters
-	Get(repoPath string) ([]byte, error)                             // Retrieve data from a repository file
-	Put(repoPath string, data []byte) error                          // Write data to a repository file
-	GetReader(repoPath string) (io.ReadCloser, error)                // Open a stream to read a repository file
-	PutReader(repoPath string, rc io.ReadCloser, length int64) error // Write a stream to a repository file
-	Delete(repoPath string) error                                    // Delete a repository file
+	init(params Params) error                                                // Set up access parameters
+	Get(repoPath string) ([]byte, error)                                     // Retrieve data from a repository file
+	Put(repoPath string, data []byte) error                                  // Write data to a repository file
+	GetReader(repoPath string) (io.ReadCloser, error)                        // Open a stream to read a repository file
+	PutReader(repoPath string, rc io.ReadCloser, length int64) error         // Write a stream to a repository file
+	Delete(repoPath string) error                                            // Delete a repository file
+	List(prefix string) ([]FileInfo, error)                                  // Enumerate the files under a path prefix
+	Stat(repoPath string) (FileInfo, error)                                  // Describe a repository file
+	Exists(repoPath string) (bool, error)                                    // Determine whether a repository file is present
+	PutMultipart(repoPath string, r io.Reader, length, partSize int64) error // Write a stream in parts, resuming an interrupted write
+	Lock(repoPath string) (func(), error)                                    // Take an advisory lock on a repository file; call the result to unlock
+}
+
+// FileInfo describes a file in the repository.
+type FileInfo struct {
+	Path    string    // The repository path of the file, without a leading "/"
+	Size    int64     // The length of the file in bytes
+	ModTime time.Time // The time at which the file was last written
 }
 
 // AccessMethod indicates where the repository data should be stored.
@@ -37,6 +50,8 @@ func New(am AccessMethod, params Params) (Storage, error) {
 		stg = &stLocal{}
 	case KST_S3:
 		stg = &stS3{}
+	case KST_HTTP:
+		stg = &stHTTP{}
 	default:
 		return nil, fmt.Errorf("Invalid AccessMethod: %s", am.String())
 	}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 const TESTAPP = "stubapp"
@@ -45,6 +49,46 @@ func TestStorageLocal(t *testing.T) {
 		t.Errorf("%s storage initialization failed: %s", KST_LOCAL, err.Error())
 	} else {
 		testStorage(t, KST_LOCAL, rs)
+		testLocalAtomic(t, rs)
+	}
+}
+
+func testLocalAtomic(t *testing.T, rs Storage) {
+
+	filename := "/" + TESTAPP + "/atomic/index.json"
+
+	// A shorter rewrite must not leave trailing data behind.
+	rs.Put(filename, []byte("a longer first version"))
+	if err := rs.Put(filename, []byte("short")); err != nil {
+		t.Errorf("%s Put() failed %s", KST_LOCAL, err.Error())
+	} else if data, _ := rs.Get(filename); string(data) != "short" {
+		t.Errorf("%s Put() error: expected %q, got %q", KST_LOCAL, "short", string(data))
+	}
+
+	// A second lock must wait for the first to be released.
+	savedTimeout := lockTimeout
+	lockTimeout = 200 * time.Millisecond
+	defer func() { lockTimeout = savedTimeout }()
+	unlock, err := rs.Lock(filename)
+	if err != nil {
+		t.Errorf("%s Lock() failed %s", KST_LOCAL, err.Error())
+		return
+	}
+	if _, err := rs.Lock(filename); err == nil {
+		t.Errorf("%s Lock() should have failed while already locked", KST_LOCAL)
+	} else {
+		fmt.Println(err.Error())
+	}
+	unlock()
+	if unlock, err := rs.Lock(filename); err != nil {
+		t.Errorf("%s Lock() failed after unlock: %s", KST_LOCAL, err.Error())
+	} else {
+		unlock()
+	}
+
+	// Neither the lock file nor any temporary file is listed.
+	if list, err := rs.List("/" + TESTAPP + "/atomic/"); err != nil || len(list) != 1 {
+		t.Errorf("%s List() error: expected 1 file, got %v (%v)", KST_LOCAL, list, err)
 	}
 }
 
@@ -66,6 +110,62 @@ func TestStorageS3(t *testing.T) {
 		fmt.Println(err.Error())
 	}
 
+	params["awsregion"] = "us-east-1"
+	params["endpoint"] = "minio.example.com:9000"
+	if _, err := New(KST_S3, params); err == nil {
+		t.Errorf("%s storage initialization succeeded with invalid endpoint", KST_S3)
+	} else {
+		fmt.Println(err.Error())
+	}
+	params["endpoint"] = "http://minio.example.com:9000"
+	params["pathstyle"] = "sometimes"
+	if _, err := New(KST_S3, params); err == nil {
+		t.Errorf("%s storage initialization succeeded with invalid pathstyle", KST_S3)
+	} else {
+		fmt.Println(err.Error())
+	}
+	delete(params, "pathstyle")
+	params["credentials"] = "telepathy"
+	if _, err := New(KST_S3, params); err == nil {
+		t.Errorf("%s storage initialization succeeded with invalid credentials source", KST_S3)
+	} else {
+		fmt.Println(err.Error())
+	}
+	params["credentials"] = "shared"
+	params["credentialsfile"] = "../data/nosuchfile"
+	if _, err := New(KST_S3, params); err == nil {
+		t.Errorf("%s storage initialization succeeded with missing credentials file", KST_S3)
+	} else {
+		fmt.Println(err.Error())
+	}
+	delete(params, "endpoint")
+	delete(params, "credentials")
+	delete(params, "credentialsfile")
+
+	// Custom endpoints use path-style addressing unless told otherwise.
+	if region, err := makeS3Region("", Params{"endpoint": "https://minio.example.com:9000"}); err != nil {
+		t.Errorf("%s custom endpoint failed: %s", KST_S3, err.Error())
+	} else if region.S3Endpoint != "https://minio.example.com:9000" || region.S3BucketEndpoint != "" {
+		t.Errorf("%s custom endpoint not path-style: %v", KST_S3, region)
+	}
+	if region, _ := makeS3Region("", Params{"endpoint": "https://minio.example.com", "pathstyle": "false"}); region.S3BucketEndpoint != "https://${bucket}.minio.example.com" {
+		t.Errorf("%s custom endpoint not virtual-host style: %q", KST_S3, region.S3BucketEndpoint)
+	}
+
+	// Run tests against an S3-compatible service such as MinIO, if one is given.
+	if endpoint := os.Getenv("PULLDEPLOY_TEST_S3_ENDPOINT"); endpoint != "" {
+		mparams := Params{
+			"endpoint": endpoint,
+			"bucket":   os.Getenv("PULLDEPLOY_TEST_S3_BUCKET"),
+			"prefix":   "unittest",
+		}
+		if rs, err := New(KST_S3, mparams); err != nil {
+			t.Errorf("%s storage initialization failed for %s: %s", KST_S3, endpoint, err.Error())
+		} else {
+			testStorage(t, KST_S3, rs)
+		}
+	}
+
 	// Set up our S3 base directory, and run tests.
 	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
 		params["awsregion"] = "us-east-1"
@@ -79,6 +179,140 @@ func TestStorageS3(t *testing.T) {
 	}
 }
 
+func TestStorageHTTP(t *testing.T) {
+
+	// Exercise the HTTP access method.
+	params := make(map[string]string)
+
+	// Test handling of initialization.
+	if _, err := New(KST_HTTP, params); err == nil {
+		t.Errorf("%s storage initialization succeeded with missing base URL", KST_HTTP)
+	} else {
+		fmt.Println(err.Error())
+	}
+	params["baseurl"] = "ftp://repo.example.com/"
+	if _, err := New(KST_HTTP, params); err == nil {
+		t.Errorf("%s storage initialization succeeded with invalid base URL", KST_HTTP)
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	// Serve a local repository, requiring a bearer token.
+	sampleBytes := []byte("This is sample repository data.\n")
+	sampleFilename := "/" + TESTAPP + "/method_http/sample data.txt"
+	local, _ := New(KST_LOCAL, Params{"basedir": "../data/repository"})
+	local.Put(sampleFilename, sampleBytes)
+	defer local.Delete(sampleFilename)
+	fileServer := http.FileServer(http.Dir("../data/repository"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sesame" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// Without the token, reads should fail.
+	params["baseurl"] = server.URL + "/"
+	rs, err := New(KST_HTTP, params)
+	if err != nil {
+		t.Fatalf("%s storage initialization failed: %s", KST_HTTP, err.Error())
+	}
+	if _, err := rs.Get(sampleFilename); err == nil {
+		t.Errorf("%s Get() should have failed without credentials", KST_HTTP)
+	} else {
+		fmt.Println(err.Error())
+	}
+
+	// With the token, reads should succeed.
+	params["bearertoken"] = "sesame"
+	rs, _ = New(KST_HTTP, params)
+	if data, err := rs.Get(sampleFilename); err != nil {
+		t.Errorf("%s Get() failed: %s", KST_HTTP, err.Error())
+	} else if bytes.Compare(sampleBytes, data) != 0 {
+		t.Errorf("%s Get() error: expected %q, got %q", KST_HTTP, string(sampleBytes), string(data))
+	}
+	if rdr, err := rs.GetReader(sampleFilename); err != nil {
+		t.Errorf("%s GetReader() failed: %s", KST_HTTP, err.Error())
+	} else {
+		data, _ := ioutil.ReadAll(rdr)
+		rdr.Close()
+		if bytes.Compare(sampleBytes, data) != 0 {
+			t.Errorf("%s GetReader() error: expected %q, got %q", KST_HTTP, string(sampleBytes), string(data))
+		}
+	}
+	if fi, err := rs.Stat(sampleFilename); err != nil || fi.Size != int64(len(sampleBytes)) {
+		t.Errorf("%s Stat() error: unexpected result %v (%v)", KST_HTTP, fi, err)
+	}
+	if exists, err := rs.Exists(sampleFilename); err != nil || !exists {
+		t.Errorf("%s Exists() error: expected true, got %v (%v)", KST_HTTP, exists, err)
+	}
+	if exists, err := rs.Exists("/" + TESTAPP + "/nosuchfile"); err != nil || exists {
+		t.Errorf("%s Exists() error: expected false, got %v (%v)", KST_HTTP, exists, err)
+	}
+	if _, err := rs.Get("/" + TESTAPP + "/nosuchfile"); err == nil {
+		t.Errorf("%s Get() should have failed for nonexistent file", KST_HTTP)
+	}
+
+	// Writes should all be refused.
+	if err := rs.Put(sampleFilename, sampleBytes); err == nil {
+		t.Errorf("%s Put() should have failed", KST_HTTP)
+	} else {
+		fmt.Println(err.Error())
+	}
+	if err := rs.PutReader(sampleFilename, ioutil.NopCloser(bytes.NewReader(sampleBytes)), int64(len(sampleBytes))); err == nil {
+		t.Errorf("%s PutReader() should have failed", KST_HTTP)
+	}
+	if err := rs.Delete(sampleFilename); err == nil {
+		t.Errorf("%s Delete() should have failed", KST_HTTP)
+	}
+}
+
+func TestStorageThrottle(t *testing.T) {
+
+	// Without a limit, the storage is returned unchanged.
+	local, _ := New(KST_LOCAL, Params{"basedir": "../data/repository"})
+	if Throttle(local, 0) != local {
+		t.Errorf("Throttle() with no limit should not wrap the storage")
+	}
+
+	// Two streams read 48KB between them, limited to 80KB per second together.
+	sampleBytes := bytes.Repeat([]byte("0123456789abcdef"), 1536)
+	sampleFilename := "/" + TESTAPP + "/throttle/sample.dat"
+	local.Put(sampleFilename, sampleBytes)
+	defer local.Delete(sampleFilename)
+	rs := Throttle(local, 80*1024)
+	start := time.Now()
+	done := make(chan []byte)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rdr, err := rs.GetReader(sampleFilename)
+			if err != nil {
+				t.Errorf("Throttled GetReader() failed: %s", err.Error())
+				done <- nil
+				return
+			}
+			data, _ := ioutil.ReadAll(rdr)
+			rdr.Close()
+			done <- data
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if data := <-done; bytes.Compare(sampleBytes, data) != 0 {
+			t.Errorf("Throttled GetReader() returned %d bytes, expected %d", len(data), len(sampleBytes))
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Throttled reads took %s, expected about 600ms", elapsed)
+	}
+
+	// Other operations are unaffected.
+	if data, err := rs.Get(sampleFilename); err != nil || len(data) != len(sampleBytes) {
+		t.Errorf("Throttled Get() failed: %v", err)
+	}
+}
+
 func testStorage(t *testing.T, am AccessMethod, rs Storage) {
 
 	fmt.Printf("Testing storage with Access Method %q\n", am)
@@ -148,6 +382,72 @@ func testStorage(t *testing.T, am AccessMethod, rs Storage) {
 		}
 	}
 
+	// List the files we wrote.
+	if list, err := rs.List("/" + TESTAPP + "/"); err != nil {
+		t.Errorf("%s List() failed %s", am, err.Error())
+	} else if len(list) != 2 {
+		t.Errorf("%s List() error: expected 2 files, got %v", am, list)
+	} else {
+		for _, fi := range list {
+			if fi.Size != int64(len(sampleBytes)) || "/"+fi.Path != sampleFilename1 && "/"+fi.Path != sampleFilename2 {
+				t.Errorf("%s List() error: unexpected entry %v", am, fi)
+			}
+		}
+	}
+	if list, err := rs.List("/" + TESTAPP + "/method_a/"); err != nil || len(list) != 1 {
+		t.Errorf("%s List() error: expected 1 file, got %v (%v)", am, list, err)
+	}
+	if list, err := rs.List("/" + TESTAPP + "/nosuchdir/"); err != nil || len(list) != 0 {
+		t.Errorf("%s List() error: expected no files, got %v (%v)", am, list, err)
+	}
+
+	// Describe the files we wrote.
+	if fi, err := rs.Stat(sampleFilename1); err != nil {
+		t.Errorf("%s Stat() failed %s", am, err.Error())
+	} else if fi.Size != int64(len(sampleBytes)) || "/"+fi.Path != sampleFilename1 {
+		t.Errorf("%s Stat() error: unexpected result %v", am, fi)
+	}
+	if _, err := rs.Stat("/" + TESTAPP + "/nosuchfile"); err == nil {
+		t.Errorf("%s Stat() should have failed for nonexistent file", am)
+	}
+	if exists, err := rs.Exists(sampleFilename2); err != nil || !exists {
+		t.Errorf("%s Exists() error: expected true, got %v (%v)", am, exists, err)
+	}
+	if exists, err := rs.Exists("/" + TESTAPP + "/nosuchfile"); err != nil || exists {
+		t.Errorf("%s Exists() error: expected false, got %v (%v)", am, exists, err)
+	}
+
+	// Write a file in parts, larger than a single part.
+	partSize := int64(7)
+	if am == KST_S3 {
+		partSize = kMIN_S3_PART_SIZE
+	}
+	multiBytes := make([]byte, partSize*5/2)
+	for i := range multiBytes {
+		multiBytes[i] = byte(i % 251)
+	}
+	multiFilename := "/" + TESTAPP + "/method_c/multipart.dat"
+	if am == KST_LOCAL {
+		// Simulate an interrupted earlier attempt, with one good and one damaged part.
+		fullPath, _ := makeLocalPath(rs.(*stLocal).baseDir, multiFilename)
+		os.MkdirAll(path.Dir(fullPath), 0755)
+		partial := append([]byte{}, multiBytes[:partSize*2]...)
+		partial[partSize] ^= 0xff
+		ioutil.WriteFile(fullPath+kPARTIAL_SUFFIX, partial, 0644)
+	}
+	if err := rs.PutMultipart(multiFilename, bytes.NewReader(multiBytes), int64(len(multiBytes)), partSize); err != nil {
+		t.Errorf("%s PutMultipart() failed %s", am, err.Error())
+	} else if data, err := rs.Get(multiFilename); err != nil || bytes.Compare(data, multiBytes) != 0 {
+		t.Errorf("%s PutMultipart() error: content differs (%v)", am, err)
+	}
+	if err := rs.PutMultipart(multiFilename, bytes.NewReader(multiBytes), int64(len(multiBytes))+1, partSize); err == nil {
+		t.Errorf("%s PutMultipart() should have failed with wrong length", am)
+	}
+	if list, err := rs.List("/" + TESTAPP + "/method_c/"); err != nil || len(list) != 1 {
+		t.Errorf("%s List() error: expected 1 file, got %v (%v)", am, list, err)
+	}
+	rs.Delete(multiFilename)
+
 	// Delete a file.
 	if err := rs.Delete(sampleFilename1); err != nil {
 		t.Errorf(err.Error())
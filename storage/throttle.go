@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// The most that a throttled stream reads at once, so that its rate is smooth.
+const kTHROTTLE_CHUNK_SIZE = 16384
+
+// stThrottled limits the combined rate of all the streams read through GetReader.
+type stThrottled struct {
+	Storage
+	limiter *rateLimiter
+}
+
+/*
+Throttle returns a Storage whose GetReader streams are limited, together, to the
+given number of bytes per second, so that fetching artifacts need not saturate
+the network. All other operations are passed through unchanged.
+*/
+func Throttle(stg Storage, bytesPerSecond int64) Storage {
+	if bytesPerSecond <= 0 {
+		return stg
+	}
+	return &stThrottled{stg, &rateLimiter{rate: bytesPerSecond}}
+}
+
+// GetReader returns a rate-limited stream handle for reading a repository file.
+func (st *stThrottled) GetReader(repoPath string) (io.ReadCloser, error) {
+	rc, err := st.Storage.GetReader(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReader{rc, st.limiter}, nil
+}
+
+// throttledReader waits on a shared rateLimiter for each chunk it reads.
+type throttledReader struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > kTHROTTLE_CHUNK_SIZE {
+		p = p[:kTHROTTLE_CHUNK_SIZE]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	tr.limiter.wait(n)
+	return n, err
+}
+
+// rateLimiter spaces out reservations of bytes to keep to a rate.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64     // Bytes per second
+	next time.Time // When the bandwidth reserved so far has been used up
+}
+
+// wait blocks until n more bytes may be read without exceeding the rate.
+func (rl *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	rl.next = rl.next.Add(time.Duration(int64(n) * int64(time.Second) / rl.rate))
+	delay := rl.next.Sub(now)
+	rl.mu.Unlock()
+	time.Sleep(delay)
+}